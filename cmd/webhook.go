@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	log "log/slog"
+	"os"
+
+	"github.com/minghsu0107/go-random-chat/internal/wire"
+	"github.com/spf13/cobra"
+)
+
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "webhook server",
+	Run: func(cmd *cobra.Command, args []string) {
+		server, err := wire.InitializeWebhookServer("webhook")
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		server.Serve()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+}
@@ -5,6 +5,7 @@ export REDIS_PASSWORD=pass.123
 export JWT_SECRET=mysecret
 export USER_OAUTH_GOOGLE_CLIENTID=xxx.apps.googleusercontent.com
 export USER_OAUTH_GOOGLE_CLIENTSECRET=xxx
+export WEBHOOK_API_KEY=mywebhookkey
 
 addHost() {
     if grep -q "minio" /etc/hosts; then
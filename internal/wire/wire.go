@@ -15,6 +15,7 @@ import (
 	"github.com/minghsu0107/go-random-chat/pkg/uploader"
 	"github.com/minghsu0107/go-random-chat/pkg/user"
 	"github.com/minghsu0107/go-random-chat/pkg/web"
+	"github.com/minghsu0107/go-random-chat/pkg/webhook"
 )
 
 func InitializeWebServer(name string) (*common.Server, error) {
@@ -72,6 +73,11 @@ func InitializeChatServer(name string) (*common.Server, error) {
 		chat.NewChannelRepoCacheImpl,
 		wire.Bind(new(chat.ChannelRepoCache), new(*chat.ChannelRepoCacheImpl)),
 
+		chat.NewMessageIndexerImpl,
+		wire.Bind(new(chat.MessageIndexer), new(*chat.MessageIndexerImpl)),
+
+		chat.NewMessageModerator,
+
 		chat.NewMessageSubscriber,
 
 		common.NewSonyFlake,
@@ -85,10 +91,15 @@ func InitializeChatServer(name string) (*common.Server, error) {
 		chat.NewForwardServiceImpl,
 		wire.Bind(new(chat.ForwardService), new(*chat.ForwardServiceImpl)),
 
+		chat.NewMessageExpirer,
+
 		chat.NewMelodyChatConn,
+		chat.NewStreamHub,
 
 		chat.NewGinServer,
 
+		chat.NewMessageRateLimiter,
+
 		chat.NewHttpServer,
 		wire.Bind(new(common.HttpServer), new(*chat.HttpServer)),
 		chat.NewGrpcServer,
@@ -165,6 +176,8 @@ func InitializeMatchServer(name string) (*common.Server, error) {
 		wire.Bind(new(match.UserService), new(*match.UserServiceImpl)),
 		match.NewMatchingServiceImpl,
 		wire.Bind(new(match.MatchingService), new(*match.MatchingServiceImpl)),
+		match.NewRoomServiceImpl,
+		wire.Bind(new(match.RoomService), new(*match.RoomServiceImpl)),
 
 		match.NewMelodyMatchConn,
 
@@ -237,3 +250,47 @@ func InitializeUserServer(name string) (*common.Server, error) {
 	)
 	return &common.Server{}, nil
 }
+
+func InitializeWebhookServer(name string) (*common.Server, error) {
+	wire.Build(
+		config.NewConfig,
+		common.NewObservabilityInjector,
+		common.NewHttpLog,
+
+		infra.NewRedisClient,
+		infra.NewRedisCacheImpl,
+		wire.Bind(new(infra.RedisCache), new(*infra.RedisCacheImpl)),
+
+		webhook.NewKafkaSubscriber,
+		infra.NewBrokerRouter,
+
+		infra.NewCassandraSession,
+
+		webhook.NewWebhookRepoImpl,
+		wire.Bind(new(webhook.WebhookRepo), new(*webhook.WebhookRepoImpl)),
+
+		webhook.NewWebhookRepoCacheImpl,
+		wire.Bind(new(webhook.WebhookRepoCache), new(*webhook.WebhookRepoCacheImpl)),
+
+		common.NewSonyFlake,
+
+		webhook.NewWebhookServiceImpl,
+		wire.Bind(new(webhook.WebhookService), new(*webhook.WebhookServiceImpl)),
+		webhook.NewDeliveryServiceImpl,
+		wire.Bind(new(webhook.DeliveryService), new(*webhook.DeliveryServiceImpl)),
+
+		webhook.NewEventSubscriber,
+		webhook.NewDeliverer,
+
+		webhook.NewGinServer,
+
+		webhook.NewHttpServer,
+		wire.Bind(new(common.HttpServer), new(*webhook.HttpServer)),
+		webhook.NewRouter,
+		wire.Bind(new(common.Router), new(*webhook.Router)),
+		webhook.NewInfraCloser,
+		wire.Bind(new(common.InfraCloser), new(*webhook.InfraCloser)),
+		common.NewServer,
+	)
+	return &common.Server{}, nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/minghsu0107/go-random-chat/pkg/uploader"
 	"github.com/minghsu0107/go-random-chat/pkg/user"
 	"github.com/minghsu0107/go-random-chat/pkg/web"
+	"github.com/minghsu0107/go-random-chat/pkg/webhook"
 )
 
 // Injectors from wire.go:
@@ -49,6 +50,7 @@ func InitializeChatServer(name string) (*common.Server, error) {
 	}
 	engine := chat.NewGinServer(name, httpLog, configConfig)
 	melodyChatConn := chat.NewMelodyChatConn(configConfig)
+	streamHub := chat.NewStreamHub(configConfig)
 	router, err := infra.NewBrokerRouter(name)
 	if err != nil {
 		return nil, err
@@ -57,15 +59,15 @@ func InitializeChatServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	messageSubscriber, err := chat.NewMessageSubscriber(name, router, configConfig, subscriber, melodyChatConn)
+	universalClient, err := infra.NewRedisClient(configConfig)
 	if err != nil {
 		return nil, err
 	}
-	universalClient, err := infra.NewRedisClient(configConfig)
+	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
+	messageSubscriber, err := chat.NewMessageSubscriber(name, httpLog, router, configConfig, subscriber, redisCacheImpl, melodyChatConn, streamHub)
 	if err != nil {
 		return nil, err
 	}
-	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
 	session, err := infra.NewCassandraSession(configConfig)
 	if err != nil {
 		return nil, err
@@ -76,28 +78,32 @@ func InitializeChatServer(name string) (*common.Server, error) {
 	}
 	userRepoImpl := chat.NewUserRepoImpl(session, userClientConn)
 	userRepoCacheImpl := chat.NewUserRepoCacheImpl(redisCacheImpl, userRepoImpl)
-	userServiceImpl := chat.NewUserServiceImpl(userRepoCacheImpl)
 	publisher, err := infra.NewKafkaPublisher(configConfig)
 	if err != nil {
 		return nil, err
 	}
+	channelRepoImpl := chat.NewChannelRepoImpl(session, publisher)
+	channelRepoCacheImpl := chat.NewChannelRepoCacheImpl(redisCacheImpl, channelRepoImpl)
+	userServiceImpl := chat.NewUserServiceImpl(httpLog, configConfig, userRepoCacheImpl, channelRepoCacheImpl)
 	messageRepoImpl := chat.NewMessageRepoImpl(configConfig, session, publisher)
-	messageRepoCacheImpl := chat.NewMessageRepoCacheImpl(messageRepoImpl)
+	messageRepoCacheImpl := chat.NewMessageRepoCacheImpl(redisCacheImpl, messageRepoImpl)
 	idGenerator, err := common.NewSonyFlake()
 	if err != nil {
 		return nil, err
 	}
-	messageServiceImpl := chat.NewMessageServiceImpl(messageRepoCacheImpl, userRepoCacheImpl, idGenerator)
-	channelRepoImpl := chat.NewChannelRepoImpl(session)
-	channelRepoCacheImpl := chat.NewChannelRepoCacheImpl(redisCacheImpl, channelRepoImpl)
-	channelServiceImpl := chat.NewChannelServiceImpl(channelRepoCacheImpl, userRepoCacheImpl, idGenerator)
+	messageIndexerImpl := chat.NewMessageIndexerImpl(redisCacheImpl, configConfig)
+	messageModerator := chat.NewMessageModerator(name, httpLog, configConfig)
+	messageServiceImpl := chat.NewMessageServiceImpl(httpLog, configConfig, messageRepoCacheImpl, userRepoCacheImpl, messageIndexerImpl, messageModerator, idGenerator)
+	channelServiceImpl := chat.NewChannelServiceImpl(httpLog, channelRepoCacheImpl, userRepoCacheImpl, messageIndexerImpl, idGenerator)
 	forwarderClientConn, err := chat.NewForwarderClientConn(configConfig)
 	if err != nil {
 		return nil, err
 	}
 	forwardRepoImpl := chat.NewForwardRepoImpl(forwarderClientConn)
 	forwardServiceImpl := chat.NewForwardServiceImpl(forwardRepoImpl)
-	httpServer := chat.NewHttpServer(name, httpLog, configConfig, engine, melodyChatConn, messageSubscriber, userServiceImpl, messageServiceImpl, channelServiceImpl, forwardServiceImpl)
+	messageExpirer := chat.NewMessageExpirer(httpLog, configConfig, messageServiceImpl)
+	messageRateLimiter := chat.NewMessageRateLimiter(universalClient, configConfig)
+	httpServer := chat.NewHttpServer(name, httpLog, configConfig, engine, melodyChatConn, streamHub, messageSubscriber, messageExpirer, userServiceImpl, messageServiceImpl, channelServiceImpl, forwardServiceImpl, messageRateLimiter)
 	grpcLog, err := common.NewGrpcLog(configConfig)
 	if err != nil {
 		return nil, err
@@ -195,7 +201,8 @@ func InitializeMatchServer(name string) (*common.Server, error) {
 	matchingRepoImpl := match.NewMatchingRepoImpl(redisCacheImpl, publisher)
 	channelRepoImpl := match.NewChannelRepoImpl(chatClientConn)
 	matchingServiceImpl := match.NewMatchingServiceImpl(matchingRepoImpl, channelRepoImpl)
-	httpServer := match.NewHttpServer(name, httpLog, configConfig, engine, melodyMatchConn, matchSubscriber, userServiceImpl, matchingServiceImpl)
+	roomServiceImpl := match.NewRoomServiceImpl(channelRepoImpl, userRepoImpl)
+	httpServer := match.NewHttpServer(name, httpLog, configConfig, engine, melodyMatchConn, matchSubscriber, userServiceImpl, matchingServiceImpl, roomServiceImpl)
 	matchRouter := match.NewRouter(httpServer)
 	infraCloser := match.NewInfraCloser()
 	observabilityInjector := common.NewObservabilityInjector(configConfig)
@@ -259,3 +266,51 @@ func InitializeUserServer(name string) (*common.Server, error) {
 	server := common.NewServer(name, router, infraCloser, observabilityInjector)
 	return server, nil
 }
+
+func InitializeWebhookServer(name string) (*common.Server, error) {
+	configConfig, err := config.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	httpLog, err := common.NewHttpLog(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	engine := webhook.NewGinServer(name, httpLog, configConfig)
+	router, err := infra.NewBrokerRouter(name)
+	if err != nil {
+		return nil, err
+	}
+	subscriber, err := webhook.NewKafkaSubscriber(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	universalClient, err := infra.NewRedisClient(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
+	session, err := infra.NewCassandraSession(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	webhookRepoImpl := webhook.NewWebhookRepoImpl(session)
+	webhookRepoCacheImpl := webhook.NewWebhookRepoCacheImpl(redisCacheImpl, webhookRepoImpl)
+	idGenerator, err := common.NewSonyFlake()
+	if err != nil {
+		return nil, err
+	}
+	deliveryServiceImpl := webhook.NewDeliveryServiceImpl(name, configConfig, webhookRepoCacheImpl, idGenerator)
+	eventSubscriber, err := webhook.NewEventSubscriber(name, router, subscriber, deliveryServiceImpl)
+	if err != nil {
+		return nil, err
+	}
+	deliverer := webhook.NewDeliverer(httpLog, configConfig, deliveryServiceImpl)
+	webhookServiceImpl := webhook.NewWebhookServiceImpl(configConfig, webhookRepoCacheImpl, idGenerator)
+	httpServer := webhook.NewHttpServer(name, httpLog, configConfig, engine, eventSubscriber, deliverer, webhookServiceImpl)
+	webhookRouter := webhook.NewRouter(httpServer)
+	infraCloser := webhook.NewInfraCloser()
+	observabilityInjector := common.NewObservabilityInjector(configConfig)
+	server := common.NewServer(name, webhookRouter, infraCloser, observabilityInjector)
+	return server, nil
+}
@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	chatpb "github.com/minghsu0107/go-random-chat/proto/chat"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/olahol/melody.v1"
+)
+
+const (
+	// JSONSubprotocol is the default websocket subprotocol, which carries JSON text frames
+	JSONSubprotocol = "randomchat.json"
+	// ProtobufSubprotocol carries binary frames of chat.Message defined in proto/chat/message.proto
+	ProtobufSubprotocol = "randomchat.protobuf"
+)
+
+// MessageCodec encodes outgoing frames and decodes incoming frames of a websocket subprotocol
+type MessageCodec interface {
+	Encode(msg *Message) ([]byte, error)
+	Decode(data []byte) (*MessagePresenter, error)
+	Binary() bool
+}
+
+var (
+	jsonCodec     MessageCodec = jsonMessageCodec{}
+	protobufCodec MessageCodec = protobufMessageCodec{}
+
+	messageCodecs = map[string]MessageCodec{
+		JSONSubprotocol:     jsonCodec,
+		ProtobufSubprotocol: protobufCodec,
+	}
+)
+
+type jsonMessageCodec struct{}
+
+func (jsonMessageCodec) Encode(msg *Message) ([]byte, error) {
+	return json.Marshal(msg.ToPresenter())
+}
+func (jsonMessageCodec) Decode(data []byte) (*MessagePresenter, error) {
+	return DecodeToMessagePresenter(data)
+}
+func (jsonMessageCodec) Binary() bool {
+	return false
+}
+
+type protobufMessageCodec struct{}
+
+func (protobufMessageCodec) Encode(msg *Message) ([]byte, error) {
+	pbMsg := &chatpb.Message{
+		MessageId: msg.MessageID,
+		Event:     int32(msg.Event),
+		UserId:    msg.UserID,
+		Payload:   msg.Payload,
+		Seen:      msg.Seen,
+		SeenBy:    int32(msg.SeenBy),
+		Time:      msg.Time,
+		EditedAt:  msg.EditedAt,
+		Deleted:   msg.Deleted,
+		Reactions: msg.Reactions,
+		ReplyTo:   msg.ReplyTo,
+		ExpireAt:  msg.ExpireAt,
+
+		Code:          msg.Code,
+		CorrelationId: msg.CorrelationID,
+		Encryption:    encodeEncryption(msg.Encryption),
+	}
+	if msg.Quote != nil {
+		pbMsg.Quote = &chatpb.Quote{
+			MessageId:  msg.Quote.MessageID,
+			Event:      int32(msg.Quote.Event),
+			UserId:     msg.Quote.UserID,
+			Payload:    msg.Quote.Payload,
+			Deleted:    msg.Quote.Deleted,
+			Encryption: encodeEncryption(msg.Quote.Encryption),
+		}
+	}
+	return proto.Marshal(pbMsg)
+}
+func (protobufMessageCodec) Decode(data []byte) (*MessagePresenter, error) {
+	var pbMsg chatpb.Message
+	if err := proto.Unmarshal(data, &pbMsg); err != nil {
+		return nil, err
+	}
+	msgPresenter := &MessagePresenter{
+		Event:   int(pbMsg.Event),
+		UserID:  strconv.FormatUint(pbMsg.UserId, 10),
+		Payload: pbMsg.Payload,
+		Time:    pbMsg.Time,
+
+		CorrelationID:  pbMsg.CorrelationId,
+		IdempotencyKey: pbMsg.IdempotencyKey,
+	}
+	if pbMsg.MessageId != 0 {
+		msgPresenter.MessageID = strconv.FormatUint(pbMsg.MessageId, 10)
+	}
+	if pbMsg.ReplyTo != 0 {
+		msgPresenter.ReplyTo = strconv.FormatUint(pbMsg.ReplyTo, 10)
+	}
+	if pbMsg.Encryption != nil {
+		msgPresenter.Encryption = &EncryptionPresenter{
+			Algorithm: pbMsg.Encryption.Alg,
+			Nonce:     pbMsg.Encryption.Nonce,
+			KeyID:     pbMsg.Encryption.KeyId,
+		}
+	}
+	return msgPresenter, nil
+}
+func (protobufMessageCodec) Binary() bool {
+	return true
+}
+
+func encodeEncryption(encryption *Encryption) *chatpb.Encryption {
+	if encryption == nil {
+		return nil
+	}
+	return &chatpb.Encryption{
+		Alg:   encryption.Algorithm,
+		Nonce: encryption.Nonce,
+		KeyId: encryption.KeyID,
+	}
+}
+
+// negotiateCodec picks the first subprotocol requested by the client that is supported,
+// which is the same one selected by the websocket upgrader
+func negotiateCodec(req *http.Request) MessageCodec {
+	for _, header := range req.Header.Values("Sec-Websocket-Protocol") {
+		for _, subprotocol := range strings.Split(header, ",") {
+			if codec, ok := messageCodecs[strings.TrimSpace(subprotocol)]; ok {
+				return codec
+			}
+		}
+	}
+	return jsonCodec
+}
+
+func getSessionCodec(sess *melody.Session) MessageCodec {
+	codec, exist := sess.Get(sessCodecKey)
+	if !exist {
+		return jsonCodec
+	}
+	return codec.(MessageCodec)
+}
+
+func writeMessage(sess *melody.Session, msg *Message) error {
+	codec := getSessionCodec(sess)
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	if codec.Binary() {
+		return sess.WriteBinary(data)
+	}
+	return sess.Write(data)
+}
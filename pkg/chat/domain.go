@@ -10,6 +10,15 @@ const (
 	EventAction
 	EventSeen
 	EventFile
+	EventError
+	EventEdit
+	EventDelete
+	EventReaction
+	EventExpire
+	EventAck
+	EventPin
+	EventUnpin
+	EventKeyExchange
 )
 
 type Action string
@@ -21,16 +30,177 @@ var (
 	EndTypingMessage Action = "endtyping"
 	OfflineMessage   Action = "offline"
 	LeavedMessage    Action = "leaved"
+	InvitedMessage   Action = "invited"
+	LeftMessage      Action = "left"
+)
+
+type ReactionOp string
+
+var (
+	ReactionAdd    ReactionOp = "add"
+	ReactionRemove ReactionOp = "remove"
 )
 
 type Message struct {
+	MessageID uint64           `json:"message_id"`
+	Event     int              `json:"event"`
+	ChannelID uint64           `json:"channel_id"`
+	UserID    uint64           `json:"user_id"`
+	Payload   string           `json:"payload"`
+	Seen      bool             `json:"seen"`
+	SeenBy    int              `json:"seen_by"`
+	Time      int64            `json:"time"`
+	EditedAt  int64            `json:"edited_at"`
+	Deleted   bool             `json:"deleted"`
+	Reactions map[string]int64 `json:"reactions"`
+	ReplyTo   uint64           `json:"reply_to"`
+	Quote     *Quote           `json:"quote"`
+	ExpireAt  int64            `json:"expire_at"`
+	// Encryption is set if the payload is end-to-end encrypted ciphertext
+	Encryption *Encryption `json:"encryption"`
+	// Code and CorrelationID are only set on the error and ack frames sent back to a session
+	Code          string `json:"code,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// IdempotencyKey is only set on incoming text and file frames
+	IdempotencyKey string `json:"-"`
+}
+
+// Quote is a short snapshot of the message being replied to
+type Quote struct {
 	MessageID uint64 `json:"message_id"`
 	Event     int    `json:"event"`
-	ChannelID uint64 `json:"channel_id"`
 	UserID    uint64 `json:"user_id"`
 	Payload   string `json:"payload"`
-	Seen      bool   `json:"seen"`
-	Time      int64  `json:"time"`
+	Deleted   bool   `json:"deleted"`
+
+	Encryption *Encryption `json:"encryption"`
+}
+
+// Encryption is the metadata of an end-to-end encrypted payload, which the server relays without reading
+type Encryption struct {
+	Algorithm string `json:"alg"`
+	Nonce     string `json:"nonce"`
+	KeyID     string `json:"kid"`
+}
+
+// PublicKey is the end-to-end encryption public key that a member publishes to a channel
+type PublicKey struct {
+	UserID    uint64 `json:"-"`
+	Algorithm string `json:"alg"`
+	Key       string `json:"key"`
+	UpdatedAt int64  `json:"-"`
+}
+
+func (k *PublicKey) ToPresenter() *PublicKeyPresenter {
+	return &PublicKeyPresenter{
+		UserID:    strconv.FormatUint(k.UserID, 10),
+		Algorithm: k.Algorithm,
+		Key:       k.Key,
+		UpdatedAt: k.UpdatedAt,
+	}
+}
+
+type Reaction struct {
+	Emoji string     `json:"emoji"`
+	Op    ReactionOp `json:"op"`
+}
+
+// Pin records that a message is pinned in a channel
+type Pin struct {
+	ChannelID uint64
+	MessageID uint64
+	PinnedBy  uint64
+	PinnedAt  int64
+}
+
+// PinnedMessage is a pinned message along with who pinned it and when
+type PinnedMessage struct {
+	Message  *Message
+	PinnedBy uint64
+	PinnedAt int64
+}
+
+func (p *PinnedMessage) ToPresenter() *PinnedMessagePresenter {
+	return &PinnedMessagePresenter{
+		Message:  *p.Message.ToPresenter(),
+		PinnedBy: strconv.FormatUint(p.PinnedBy, 10),
+		PinnedAt: p.PinnedAt,
+	}
+}
+
+// ReadReceipt is the read progress of a user in a channel
+type ReadReceipt struct {
+	UserID            uint64
+	LastSeenMessageID uint64
+	UnreadCount       int64
+	UnreadCapped      bool
+}
+
+func (r *ReadReceipt) ToPresenter() *ReadReceiptPresenter {
+	return &ReadReceiptPresenter{
+		UserID:            strconv.FormatUint(r.UserID, 10),
+		LastSeenMessageID: strconv.FormatUint(r.LastSeenMessageID, 10),
+		UnreadCount:       r.UnreadCount,
+		UnreadCapped:      r.UnreadCapped,
+	}
+}
+
+// TranscriptMessage is a message in an exported channel transcript
+type TranscriptMessage struct {
+	MessageID uint64
+	Event     int
+	UserID    uint64
+	UserName  string
+	Payload   string
+	FileName  string
+	FileURL   string
+	Time      int64
+	EditedAt  int64
+	Deleted   bool
+	ReplyTo   uint64
+	Encrypted bool
+}
+
+// FilePayload is the payload of a file message
+type FilePayload struct {
+	FileName  string `json:"file_name"`
+	FileURL   string `json:"file_url,omitempty"`
+	ObjectKey string `json:"object_key,omitempty"`
+}
+
+func (m *TranscriptMessage) ToPresenter() *TranscriptMessagePresenter {
+	replyTo := ""
+	if m.ReplyTo != 0 {
+		replyTo = strconv.FormatUint(m.ReplyTo, 10)
+	}
+	return &TranscriptMessagePresenter{
+		MessageID: strconv.FormatUint(m.MessageID, 10),
+		Event:     m.Event,
+		UserID:    strconv.FormatUint(m.UserID, 10),
+		UserName:  m.UserName,
+		Payload:   m.Payload,
+		FileName:  m.FileName,
+		FileURL:   m.FileURL,
+		Time:      m.Time,
+		EditedAt:  m.EditedAt,
+		Deleted:   m.Deleted,
+		ReplyTo:   replyTo,
+		Encrypted: m.Encrypted,
+	}
+}
+
+// MessageRef identifies a message in a channel
+type MessageRef struct {
+	ChannelID uint64
+	MessageID uint64
+}
+
+// MessageQuery selects messages by a range of message IDs
+type MessageQuery struct {
+	BeforeID uint64
+	AfterID  uint64
+	Limit    int
+	Asc      bool
 }
 
 type Channel struct {
@@ -43,18 +213,96 @@ type User struct {
 	Name string
 }
 
+// Types of channel lifecycle events
+const (
+	ChannelCreated = "channel.created"
+	UserJoined     = "user.joined"
+	ChannelDeleted = "channel.deleted"
+)
+
+// ChannelEvent is a lifecycle event of a channel published to ChannelEventTopic.
+// UserID is only set for UserJoined
+type ChannelEvent struct {
+	Type      string `json:"type"`
+	ChannelID uint64 `json:"channel_id"`
+	UserID    uint64 `json:"user_id"`
+	Time      int64  `json:"time"`
+}
+
+func (e *ChannelEvent) Encode() []byte {
+	result, _ := json.Marshal(e)
+	return result
+}
+
 func (m *Message) Encode() []byte {
 	result, _ := json.Marshal(m)
 	return result
 }
 
+func (m *Message) ToQuote() *Quote {
+	payload := m.Payload
+	// ciphertext cannot be truncated
+	if m.Event == EventText && m.Encryption == nil {
+		payload = truncate(payload, maxQuotePayloadRunes)
+	}
+	return &Quote{
+		MessageID:  m.MessageID,
+		Event:      m.Event,
+		UserID:     m.UserID,
+		Payload:    payload,
+		Deleted:    m.Deleted,
+		Encryption: m.Encryption,
+	}
+}
+
+func (q *Quote) ToPresenter() *QuotePresenter {
+	return &QuotePresenter{
+		MessageID:  strconv.FormatUint(q.MessageID, 10),
+		Event:      q.Event,
+		UserID:     strconv.FormatUint(q.UserID, 10),
+		Payload:    q.Payload,
+		Deleted:    q.Deleted,
+		Encryption: q.Encryption.ToPresenter(),
+	}
+}
+
+// ToPresenter returns nil for a plaintext payload
+func (e *Encryption) ToPresenter() *EncryptionPresenter {
+	if e == nil {
+		return nil
+	}
+	return &EncryptionPresenter{
+		Algorithm: e.Algorithm,
+		Nonce:     e.Nonce,
+		KeyID:     e.KeyID,
+	}
+}
+
 func (m *Message) ToPresenter() *MessagePresenter {
+	var replyTo string
+	if m.ReplyTo != 0 {
+		replyTo = strconv.FormatUint(m.ReplyTo, 10)
+	}
+	var quote *QuotePresenter
+	if m.Quote != nil {
+		quote = m.Quote.ToPresenter()
+	}
 	return &MessagePresenter{
-		MessageID: strconv.FormatUint(m.MessageID, 10),
-		Event:     m.Event,
-		UserID:    strconv.FormatUint(m.UserID, 10),
-		Payload:   m.Payload,
-		Seen:      m.Seen,
-		Time:      m.Time,
+		MessageID:     strconv.FormatUint(m.MessageID, 10),
+		Event:         m.Event,
+		UserID:        strconv.FormatUint(m.UserID, 10),
+		Payload:       m.Payload,
+		Seen:          m.Seen,
+		SeenBy:        m.SeenBy,
+		Time:          m.Time,
+		EditedAt:      m.EditedAt,
+		Deleted:       m.Deleted,
+		Reactions:     m.Reactions,
+		ReplyTo:       replyTo,
+		Quote:         quote,
+		ExpireAt:      m.ExpireAt,
+		Encryption:    m.Encryption.ToPresenter(),
+		Code:          m.Code,
+		CorrelationID: m.CorrelationID,
 	}
 }
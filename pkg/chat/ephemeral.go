@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// ephemeralActions are transient signals that are neither stored nor replayed,
+// so they are delivered over redis pub/sub instead of kafka.
+//
+// Presence is split across the two transports: joined, waiting and offline travel over pub/sub
+// while leaved and left stay on kafka, since they are stored and close the sessions of the channel.
+// A presence event can therefore overtake or trail a leave. This is acceptable because presence
+// events carry no state of their own; clients refetch the online users on each of them,
+// and a leave closes the sessions it applies to whenever it arrives
+var ephemeralActions = map[Action]struct{}{
+	WaitingMessage:   {},
+	JoinedMessage:    {},
+	IsTypingMessage:  {},
+	EndTypingMessage: {},
+	OfflineMessage:   {},
+}
+
+func IsEphemeralAction(action Action) bool {
+	_, ok := ephemeralActions[action]
+	return ok
+}
+
+// typingThrottle drops typing indicators of a session that arrive faster than the interval
+type typingThrottle struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	typing     bool
+	lastTyping time.Time
+}
+
+func newTypingThrottle(interval time.Duration) *typingThrottle {
+	return &typingThrottle{
+		interval: interval,
+	}
+}
+
+// allow reports whether the action should be broadcast. A repeated istyping is only let through
+// after the interval, and endtyping is only let through if the user is typing
+func (t *typingThrottle) allow(action Action, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch action {
+	case IsTypingMessage:
+		if t.typing && now.Sub(t.lastTyping) < t.interval {
+			return false
+		}
+		t.typing = true
+		t.lastTyping = now
+	case EndTypingMessage:
+		if !t.typing {
+			return false
+		}
+		t.typing = false
+	}
+	return true
+}
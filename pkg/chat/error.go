@@ -1,9 +1,126 @@
 package chat
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
 
 var (
 	ErrUserNotFound           = errors.New("error user not found")
 	ErrChannelOrUserNotFound  = errors.New("error channel or user not found")
 	ErrExceedMessageNumLimits = errors.New("error exceed max number of messages")
+	ErrSenderMismatch         = errors.New("error sender does not match session user")
+	ErrSessionNotInitialized  = errors.New("error chat session not initialized")
+	ErrMessageNotFound        = errors.New("error message not found")
+	ErrMessageNotOwned        = errors.New("error message not sent by user")
+	ErrMessageNotEditable     = errors.New("error message not editable")
+	ErrMessageNotDeletable    = errors.New("error message not deletable")
+	ErrInvalidReaction        = errors.New("error invalid reaction")
+	ErrInvalidReplyTarget     = errors.New("error invalid reply target")
+	ErrReplayTruncated        = errors.New("error too many missed messages; fetch the rest from message history")
+	ErrInvalidExportFormat    = errors.New("error invalid export format")
+	ErrInvalidRetention       = errors.New("error invalid retention")
+	ErrChannelFull            = errors.New("error channel has reached its member limit")
+	ErrInvalidMemberLimit     = errors.New("error invalid member limit")
+	ErrTokenReused            = errors.New("error access token already refreshed")
+	ErrRateLimited            = errors.New("error too many messages; slow down")
+	ErrMessageRejected        = errors.New("error message rejected")
+	ErrInvalidFrame           = errors.New("error invalid message frame")
+	ErrInvalidEvent           = errors.New("error invalid event type")
+	ErrInvalidIdempotencyKey  = errors.New("error invalid idempotency key")
+	ErrSendInProgress         = errors.New("error message with the same idempotency key is still being sent")
+	ErrMessageNotPinnable     = errors.New("error message not pinnable")
+	ErrMessageNotPinned       = errors.New("error message not pinned")
+	ErrTooManyPins            = errors.New("error channel has reached its pinned message limit")
+	ErrInvalidEncryption      = errors.New("error invalid encryption metadata")
+	ErrInvalidPublicKey       = errors.New("error invalid public key")
+	ErrMessageTooLarge        = errors.New("error message too large")
+	ErrStreamNotFound         = errors.New("error stream not found")
+)
+
+// Codes of the error frames sent over the chat websocket
+const (
+	CodeBadRequest      = "bad_request"
+	CodeUnauthorized    = "unauthorized"
+	CodeForbidden       = "forbidden"
+	CodeNotFound        = "not_found"
+	CodeConflict        = "conflict"
+	CodeRejected        = "rejected"
+	CodeRateLimited     = "rate_limited"
+	CodeLimitExceeded   = "limit_exceeded"
+	CodeReplayTruncated = "replay_truncated"
+	CodeInternal        = "internal"
 )
+
+// errorStatuses maps the codes of error frames to the status codes of frames sent over http
+var errorStatuses = map[string]int{
+	CodeBadRequest:    http.StatusBadRequest,
+	CodeUnauthorized:  http.StatusUnauthorized,
+	CodeForbidden:     http.StatusForbidden,
+	CodeNotFound:      http.StatusNotFound,
+	CodeConflict:      http.StatusConflict,
+	CodeRejected:      http.StatusUnprocessableEntity,
+	CodeRateLimited:   http.StatusTooManyRequests,
+	CodeLimitExceeded: http.StatusConflict,
+}
+
+func getErrorStatus(code string) int {
+	status, ok := errorStatuses[code]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// getErrorFrame returns the code and the client-facing message of an error frame.
+// Errors that the client cannot act on are reported as CodeInternal without details
+func getErrorFrame(err error) (string, string) {
+	code := getErrorCode(err)
+	if code == CodeInternal {
+		return code, common.ErrServer.Error()
+	}
+	// report the innermost error, which is free of server-side context,
+	// but keep the reason of a moderation rejection
+	for {
+		if modErr, ok := err.(*ModerationError); ok {
+			return code, modErr.Error()
+		}
+		next := errors.Unwrap(err)
+		if next == nil {
+			return code, err.Error()
+		}
+		err = next
+	}
+}
+
+func getErrorCode(err error) string {
+	var numErr *strconv.NumError
+	switch {
+	case errors.Is(err, ErrMessageRejected):
+		return CodeRejected
+	case errors.Is(err, ErrRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, ErrExceedMessageNumLimits), errors.Is(err, ErrTooManyPins):
+		return CodeLimitExceeded
+	case errors.Is(err, ErrReplayTruncated):
+		return CodeReplayTruncated
+	case errors.Is(err, common.ErrInvalidToken), errors.Is(err, common.ErrTokenExpired), errors.Is(err, common.ErrTokenRevoked):
+		return CodeUnauthorized
+	case errors.Is(err, ErrSenderMismatch), errors.Is(err, ErrMessageNotOwned),
+		errors.Is(err, ErrMessageNotEditable), errors.Is(err, ErrMessageNotDeletable), errors.Is(err, ErrMessageNotPinnable):
+		return CodeForbidden
+	case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrMessageNotPinned), errors.Is(err, ErrChannelOrUserNotFound),
+		errors.Is(err, ErrStreamNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrSendInProgress):
+		return CodeConflict
+	case errors.Is(err, ErrInvalidFrame), errors.Is(err, ErrInvalidEvent), errors.Is(err, ErrInvalidReaction), errors.Is(err, ErrInvalidIdempotencyKey),
+		errors.Is(err, ErrInvalidEncryption), errors.Is(err, ErrInvalidPublicKey),
+		errors.Is(err, ErrInvalidReplyTarget), errors.As(err, &numErr):
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
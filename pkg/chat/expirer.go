@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const expireBatchSize = 100
+
+// MessageExpirer periodically removes messages whose retention is over.
+// Every chat node runs one, and the expiry schedule in redis hands each message to a single node
+type MessageExpirer struct {
+	logger   common.HttpLog
+	msgSvc   MessageService
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func NewMessageExpirer(logger common.HttpLog, config *config.Config, msgSvc MessageService) *MessageExpirer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MessageExpirer{
+		logger:   logger,
+		msgSvc:   msgSvc,
+		interval: time.Duration(config.Chat.Message.ExpireIntervalMs) * time.Millisecond,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (e *MessageExpirer) Run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.expire()
+		}
+	}
+}
+
+// expire drains all due messages in batches
+func (e *MessageExpirer) expire() {
+	for {
+		expired, err := e.msgSvc.ExpireMessages(e.ctx, expireBatchSize)
+		if err != nil {
+			e.logger.Error(err.Error())
+			return
+		}
+		if expired < expireBatchSize {
+			return
+		}
+	}
+}
+
+func (e *MessageExpirer) GracefulStop() {
+	e.cancel()
+}
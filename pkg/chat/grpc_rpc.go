@@ -2,6 +2,7 @@ package chat
 
 import (
 	"context"
+	"errors"
 
 	chatpb "github.com/minghsu0107/go-random-chat/proto/chat"
 	"google.golang.org/grpc/codes"
@@ -9,8 +10,11 @@ import (
 )
 
 func (srv *GrpcServer) CreateChannel(ctx context.Context, req *chatpb.CreateChannelRequest) (*chatpb.CreateChannelResponse, error) {
-	channel, err := srv.chanSvc.CreateChannel(ctx)
+	channel, err := srv.chanSvc.CreateChannel(ctx, req.RetentionSec, int(req.MaxMembers))
 	if err != nil {
+		if errors.Is(err, ErrInvalidRetention) || errors.Is(err, ErrInvalidMemberLimit) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 		srv.logger.Error(err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -22,6 +26,9 @@ func (srv *GrpcServer) CreateChannel(ctx context.Context, req *chatpb.CreateChan
 
 func (srv *GrpcServer) AddUserToChannel(ctx context.Context, req *chatpb.AddUserRequest) (*chatpb.AddUserResponse, error) {
 	if err := srv.userSvc.AddUserToChannel(ctx, req.ChannelId, req.UserId); err != nil {
+		if errors.Is(err, ErrChannelFull) {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
 		srv.logger.Error(err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
@@ -20,7 +21,13 @@ import (
 )
 
 var (
-	sessCidKey = "sesscid"
+	sessCidKey       = "sesscid"
+	sessUidKey       = "sessuid"
+	sessAccessKey    = "sessaccess"
+	sessDlvKey       = "sessdlv"
+	sessCodecKey     = "sesscodec"
+	sessTypingKey    = "sesstyping"
+	sessViolationKey = "sessviolation"
 
 	MelodyChat MelodyChatConn
 )
@@ -30,23 +37,40 @@ type MelodyChatConn struct {
 }
 
 type HttpServer struct {
-	name          string
-	logger        common.HttpLog
-	svr           *gin.Engine
-	mc            MelodyChatConn
-	httpPort      string
-	httpServer    *http.Server
-	msgSubscriber *MessageSubscriber
-	userSvc       UserService
-	msgSvc        MessageService
-	chanSvc       ChannelService
-	forwardSvc    ForwardService
-	serveSwag     bool
+	name           string
+	logger         common.HttpLog
+	svr            *gin.Engine
+	mc             MelodyChatConn
+	streams        *StreamHub
+	httpPort       string
+	httpServer     *http.Server
+	msgSubscriber  *MessageSubscriber
+	msgExpirer     *MessageExpirer
+	userSvc        UserService
+	msgSvc         MessageService
+	chanSvc        ChannelService
+	forwardSvc     ForwardService
+	msgRateLimiter *MessageRateLimiter
+	serveSwag      bool
+	maxReplayNum   int
+	maxMessageSize int64
+	typingThrottle time.Duration
 }
 
+// sessionBufferSize is the number of frames queued to a websocket session, beyond which melody drops frames.
+// Replay is capped well below it, since a reconnecting session is sent all of its replayed
+// and buffered frames at once
+const (
+	sessionBufferSize = 256
+	maxReplayNum      = sessionBufferSize / 2
+	maxBufferedNum    = sessionBufferSize / 4
+)
+
 func NewMelodyChatConn(config *config.Config) MelodyChatConn {
 	m := melody.New()
 	m.Config.MaxMessageSize = config.Chat.Message.MaxSizeByte
+	m.Config.MessageBufferSize = sessionBufferSize
+	m.Upgrader.Subprotocols = []string{JSONSubprotocol, ProtobufSubprotocol}
 	MelodyChat = MelodyChatConn{
 		m,
 	}
@@ -69,27 +93,38 @@ func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gi
 	return svr
 }
 
-func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mc MelodyChatConn, msgSubscriber *MessageSubscriber, userSvc UserService, msgSvc MessageService, chanSvc ChannelService, forwardSvc ForwardService) *HttpServer {
+func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mc MelodyChatConn, streams *StreamHub, msgSubscriber *MessageSubscriber, msgExpirer *MessageExpirer, userSvc UserService, msgSvc MessageService, chanSvc ChannelService, forwardSvc ForwardService, msgRateLimiter *MessageRateLimiter) *HttpServer {
 	initJWT(config)
 
+	replayNum := config.Chat.Message.MaxReplayNum
+	if replayNum > maxReplayNum {
+		replayNum = maxReplayNum
+	}
 	return &HttpServer{
-		name:          name,
-		logger:        logger,
-		svr:           svr,
-		mc:            mc,
-		httpPort:      config.Chat.Http.Server.Port,
-		msgSubscriber: msgSubscriber,
-		userSvc:       userSvc,
-		msgSvc:        msgSvc,
-		chanSvc:       chanSvc,
-		forwardSvc:    forwardSvc,
-		serveSwag:     config.Chat.Http.Server.Swag,
+		name:           name,
+		logger:         logger,
+		svr:            svr,
+		mc:             mc,
+		streams:        streams,
+		httpPort:       config.Chat.Http.Server.Port,
+		msgSubscriber:  msgSubscriber,
+		msgExpirer:     msgExpirer,
+		userSvc:        userSvc,
+		msgSvc:         msgSvc,
+		chanSvc:        chanSvc,
+		forwardSvc:     forwardSvc,
+		msgRateLimiter: msgRateLimiter,
+		serveSwag:      config.Chat.Http.Server.Swag,
+		maxReplayNum:   replayNum,
+		maxMessageSize: config.Chat.Message.MaxSizeByte,
+		typingThrottle: time.Duration(config.Chat.Message.TypingThrottleMs) * time.Millisecond,
 	}
 }
 
 func initJWT(config *config.Config) {
 	common.JwtSecret = config.Chat.JWT.Secret
 	common.JwtExpirationSecond = config.Chat.JWT.ExpirationSecond
+	common.JwtRefreshGraceSecond = config.Chat.JWT.RefreshGraceSecond
 }
 
 // @title           Chat Service Swagger API
@@ -108,25 +143,46 @@ func (r *HttpServer) RegisterRoutes() {
 		chatGroup.GET("", r.StartChat)
 
 		forwardAuthGroup := chatGroup.Group("/forwardauth")
-		forwardAuthGroup.Use(common.JWTAuth())
+		forwardAuthGroup.Use(common.JWTAuth(r.chanSvc))
 		{
 			forwardAuthGroup.Any("", r.ForwardAuth)
 		}
 
 		usersGroup := chatGroup.Group("/users")
-		usersGroup.Use(common.JWTAuth())
+		usersGroup.Use(common.JWTAuth(r.chanSvc))
 		{
 			usersGroup.GET("", r.GetChannelUsers)
 			usersGroup.GET("/online", r.GetOnlineUsers)
 		}
+		chatGroup.POST("/channel/token", r.RefreshChannelToken)
+
+		streamGroup := chatGroup.Group("/stream")
+		{
+			streamGroup.GET("", r.StreamChat)
+			streamGroup.POST("", common.JWTAuth(r.chanSvc), r.SendStreamMessage)
+		}
+
 		channelGroup := chatGroup.Group("/channel")
-		channelGroup.Use(common.JWTAuth())
+		channelGroup.Use(common.JWTAuth(r.chanSvc))
 		{
 			channelGroup.GET("/messages", r.ListMessages)
+			channelGroup.POST("/messages", r.SendMessage)
+			channelGroup.GET("/messages/search", r.SearchMessages)
+			channelGroup.GET("/export", r.ExportMessages)
+			channelGroup.GET("/retention", r.GetChannelRetention)
+			channelGroup.PUT("/retention", r.SetChannelRetention)
+			channelGroup.GET("/limit", r.GetChannelMemberLimit)
+			channelGroup.PUT("/limit", r.SetChannelMemberLimit)
+			channelGroup.POST("/members", r.InviteChannelMember)
+			channelGroup.DELETE("/members", r.LeaveChannel)
+			channelGroup.GET("/unread", r.GetReadReceipts)
+			channelGroup.GET("/pins", r.GetPinnedMessages)
+			channelGroup.GET("/keys", r.GetPublicKeys)
 			channelGroup.DELETE("", r.DeleteChannel)
 		}
 	}
 	r.mc.HandleMessage(r.HandleChatOnMessage)
+	r.mc.HandleMessageBinary(r.HandleChatOnMessage)
 	r.mc.HandleConnect(r.HandleChatOnConnect)
 	r.mc.HandleClose(r.HandleChatOnClose)
 
@@ -156,16 +212,19 @@ func (r *HttpServer) Run() {
 			os.Exit(1)
 		}
 	}()
+	go r.msgExpirer.Run()
 }
 func (r *HttpServer) GracefulStop(ctx context.Context) error {
 	err := MelodyChat.Close()
 	if err != nil {
 		return err
 	}
+	r.streams.Close()
 	err = r.httpServer.Shutdown(ctx)
 	if err != nil {
 		return err
 	}
+	r.msgExpirer.GracefulStop()
 	err = r.msgSubscriber.GracefulStop()
 	if err != nil {
 		return err
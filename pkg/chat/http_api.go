@@ -3,8 +3,12 @@ package chat
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
@@ -17,27 +21,52 @@ import (
 // @Produce json
 // @Param uid query int true "user id"
 // @Param access_token query string true "access token of the channel"
+// @Param last_mid query string false "id of the last received message; up to chat.message.maxReplayNum messages after it are replayed on connection. Edits, deletes and reactions to messages up to last_mid are not replayed, so clients refetch those from message history"
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
 // @Failure 404 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
 // @Router /chat [get]
 func (r *HttpServer) StartChat(c *gin.Context) {
+	channelID, userID, family, lastMessageID, ok := r.authorizeChat(c)
+	if !ok {
+		return
+	}
+	if err := r.mc.HandleRequestWithKeys(c.Writer, c.Request, map[string]interface{}{
+		sessCidKey:       channelID,
+		sessUidKey:       userID,
+		sessAccessKey:    newSessionAccess(family),
+		sessDlvKey:       newSessionDelivery(lastMessageID),
+		sessCodecKey:     negotiateCodec(c.Request),
+		sessTypingKey:    newTypingThrottle(r.typingThrottle),
+		sessViolationKey: r.msgRateLimiter.newViolationTracker(),
+	}); err != nil {
+		r.logger.Error("upgrade websocket error: " + err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+}
+
+// authorizeChat checks the user and channel token of a chat connection and returns the refresh family of the token
+// and the ID of the last message received by the client, given by the Last-Event-ID header
+// of a reconnecting event source or by the last_mid query.
+// It responds with an error and reports false if the connection is not allowed
+func (r *HttpServer) authorizeChat(c *gin.Context) (uint64, uint64, string, uint64, bool) {
 	uid := c.Query("uid")
 	userID, err := strconv.ParseUint(uid, 10, 64)
 	if err != nil {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
-		return
+		return 0, 0, "", 0, false
 	}
 	_, err = r.userSvc.GetUser(c.Request.Context(), userID)
 	if err != nil {
 		if errors.Is(err, ErrUserNotFound) {
 			response(c, http.StatusNotFound, ErrUserNotFound)
-			return
+			return 0, 0, "", 0, false
 		}
 		r.logger.Error(err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
-		return
+		return 0, 0, "", 0, false
 	}
 
 	accessToken := c.Query("access_token")
@@ -46,29 +75,203 @@ func (r *HttpServer) StartChat(c *gin.Context) {
 	})
 	if err != nil {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
-		return
+		return 0, 0, "", 0, false
 	}
 	if authResult.Expired {
 		r.logger.Error(common.ErrTokenExpired.Error())
 		response(c, http.StatusUnauthorized, common.ErrTokenExpired)
+		return 0, 0, "", 0, false
 	}
 	channelID := authResult.ChannelID
+	revoked, err := r.chanSvc.IsTokenRevoked(c.Request.Context(), channelID, authResult.Family)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return 0, 0, "", 0, false
+	}
+	if revoked {
+		response(c, http.StatusUnauthorized, common.ErrTokenRevoked)
+		return 0, 0, "", 0, false
+	}
 	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
 	if err != nil {
 		r.logger.Error(err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
-		return
+		return 0, 0, "", 0, false
 	}
 	if !exist {
 		response(c, http.StatusNotFound, ErrChannelOrUserNotFound)
+		return 0, 0, "", 0, false
+	}
+
+	// a reconnecting event source requests its original url, so the last event it received takes precedence
+	lastMid := c.GetHeader("Last-Event-ID")
+	if lastMid == "" {
+		lastMid = c.Query("last_mid")
+	}
+	var lastMessageID uint64
+	if lastMid != "" {
+		lastMessageID, err = strconv.ParseUint(lastMid, 10, 64)
+		if err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return 0, 0, "", 0, false
+		}
+	}
+	return channelID, userID, authResult.Family, lastMessageID, true
+}
+
+// @Summary Stream chat
+// @Description Receive channel events as server-sent events, a fallback for clients that cannot open a websocket. The first event is a stream event whose data is the ID of the connection. Frames are sent with POST /chat/stream, naming the connection by its ID
+// @Tags chat
+// @Produce text/event-stream
+// @Param uid query int true "user id"
+// @Param access_token query string true "access token of the channel"
+// @Param last_mid query string false "id of the last received message; up to chat.message.maxReplayNum messages after it are replayed on connection. Edits, deletes and reactions to messages up to last_mid are not replayed, so clients refetch those from message history"
+// @Param Last-Event-ID header string false "id of the last received event, sent by a reconnecting event source"
+// @Success 200 {string} string "stream of JSON chat frames"
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/stream [get]
+func (r *HttpServer) StreamChat(c *gin.Context) {
+	channelID, userID, family, lastMessageID, ok := r.authorizeChat(c)
+	if !ok {
 		return
 	}
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// keep reverse proxies from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
 
-	if err := r.mc.HandleRequest(c.Writer, c.Request); err != nil {
-		r.logger.Error("upgrade websocket error: " + err.Error())
-		response(c, http.StatusInternalServerError, common.ErrServer)
+	conn, err := r.streams.register(channelID, userID, family, lastMessageID, newTypingThrottle(r.typingThrottle), r.msgRateLimiter.newViolationTracker())
+	if err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+	defer r.streams.unregister(conn)
+	if err := writeStreamOpen(c.Writer, conn.id); err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+	send := func(msg *Message) {
+		if err := writeStreamEvent(c.Writer, msg); err != nil {
+			r.logger.Error(err.Error())
+		}
+	}
+	defer func() {
+		if err := r.closeChatSession(channelID, userID); err != nil {
+			r.logger.Error(err.Error())
+		}
+	}()
+	if err := r.initializeChatSession(channelID, userID); err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+	if err := r.replay(conn.delivery, channelID, send); err != nil {
+		r.logger.Error(err.Error())
+	}
+	c.Writer.Flush()
+	if err := r.msgSvc.BroadcastConnectMessage(context.Background(), channelID, userID); err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+
+	keepalive := time.NewTicker(r.streams.keepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-conn.send:
+			send(msg)
+			c.Writer.Flush()
+		case <-keepalive.C:
+			if err := writeStreamKeepalive(c.Writer); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-conn.closed:
+			// flush the messages queued before the connection was closed, such as the leave message of a deleted channel
+			for {
+				select {
+				case msg := <-conn.send:
+					send(msg)
+				default:
+					c.Writer.Flush()
+					return
+				}
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// @Summary Send stream message
+// @Description Send a chat frame over http, for clients that receive channel events with GET /chat/stream. The frame is sent as the user of the open stream named by X-Stream-Id, which must be held by the same chat instance, and it is throttled like a websocket frame. A stream that keeps exceeding the rate limits or whose user is no longer in the channel is closed. A successful frame is answered with an ack frame and a failed one with an error frame
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @param X-Stream-Id header string true "id of the open stream"
+// @Param message body MessagePresenter true "chat frame"
+// @Success 200 {object} MessagePresenter
+// @Failure 400 {object} MessagePresenter
+// @Failure 401 {object} MessagePresenter
+// @Failure 403 {object} MessagePresenter
+// @Failure 404 {object} MessagePresenter
+// @Failure 409 {object} MessagePresenter
+// @Failure 422 {object} MessagePresenter
+// @Failure 429 {object} MessagePresenter
+// @Failure 500 {object} MessagePresenter
+// @Router /chat/stream [post]
+func (r *HttpServer) SendStreamMessage(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	conn := r.streams.lookup(c.GetHeader(StreamIdHeader))
+	if conn == nil || conn.channelID != channelID {
+		r.respondErrorMessage(c, "", ErrStreamNotFound)
+		return
+	}
+	var msgPresenter MessagePresenter
+	if err := c.ShouldBindJSON(&msgPresenter); err != nil {
+		r.respondErrorMessage(c, "", fmt.Errorf("error decode message frame: %w: %v", ErrInvalidFrame, err))
+		return
+	}
+	correlationID := msgPresenter.CorrelationID
+	msg, err := msgPresenter.toMessage(conn.channelID, conn.userID)
+	if err != nil {
+		r.respondErrorMessage(c, correlationID, err)
+		return
+	}
+	allow, err := r.msgRateLimiter.Allow(c.Request.Context(), msg.ChannelID, msg.UserID, msg.Event)
+	if err != nil {
+		r.respondErrorMessage(c, correlationID, err)
+		return
+	}
+	if !allow {
+		if conn.violations.record(time.Now()) {
+			conn.close()
+		}
+		r.respondErrorMessage(c, correlationID, ErrRateLimited)
+		return
+	}
+	if err := r.checkSessionAccess(c.Request.Context(), conn.channelID, conn.access); err != nil {
+		r.closeUnauthorizedStream(conn, err)
+		r.respondErrorMessage(c, correlationID, err)
+		return
+	}
+	messageID, err := r.handleMessage(msg, conn.typing)
+	if err != nil {
+		r.respondErrorMessage(c, correlationID, err)
 		return
 	}
+	c.JSON(http.StatusOK, newAckMessage(correlationID, messageID).ToPresenter())
 }
 
 // @Summary Forward auth
@@ -154,12 +357,19 @@ func (r *HttpServer) GetOnlineUsers(c *gin.Context) {
 }
 
 // @Summary List channel messages
-// @Description List messages of a channel
+// @Description List messages of a channel. Messages are paged by page state unless any of before, after, since, until, limit or order is given
 // @Tags chat
 // @Produce json
 // @param Authorization header string true "channel authorization"
 // @Param ps query string false "page state"
+// @Param before query string false "list messages before this message id"
+// @Param after query string false "list messages after this message id"
+// @Param since query int false "list messages sent at or after this unix timestamp in milliseconds"
+// @Param until query int false "list messages sent at or before this unix timestamp in milliseconds"
+// @Param limit query int false "max number of messages"
+// @Param order query string false "asc or desc (default)"
 // @Success 200 {object} MessagesPresenter
+// @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
 // @Failure 404 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
@@ -170,6 +380,28 @@ func (r *HttpServer) ListMessages(c *gin.Context) {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
+	query, isRangeQuery, err := parseMessageQuery(c)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if isRangeQuery {
+		msgs, hasMore, err := r.msgSvc.QueryMessages(c.Request.Context(), channelID, query)
+		if err != nil {
+			r.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		msgsPresenter := []MessagePresenter{}
+		for _, msg := range msgs {
+			msgsPresenter = append(msgsPresenter, *msg.ToPresenter())
+		}
+		c.JSON(http.StatusOK, &MessagesPresenter{
+			HasMore:  hasMore,
+			Messages: msgsPresenter,
+		})
+		return
+	}
 	pageState := c.Query("ps")
 	msgs, nextPageState, err := r.msgSvc.ListMessages(c.Request.Context(), channelID, pageState)
 	if err != nil {
@@ -183,34 +415,61 @@ func (r *HttpServer) ListMessages(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, &MessagesPresenter{
 		NextPageState: nextPageState,
+		HasMore:       nextPageState != "",
 		Messages:      msgsPresenter,
 	})
 }
 
-// @Summary Delete channel
-// @Description Delete a channel
+// @Summary Send message
+// @Description Send a text or file message to a channel without holding a websocket, for integrations and bots. Event is 0 for text and 3 for file
 // @Tags chat
+// @Accept json
 // @Produce json
 // @param Authorization header string true "channel authorization"
-// @Param delby query string true "id of the user that performs the deletion"
-// @Success 204 {object} common.SuccessMessage
+// @Param uid query string true "id of the member that sends the message"
+// @Param message body SendMessagePresenter true "message"
+// @Success 201 {object} MessagePresenter
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
 // @Failure 404 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 422 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
-// @Router /chat/channel [delete]
-func (r *HttpServer) DeleteChannel(c *gin.Context) {
+// @Router /chat/channel/messages [post]
+func (r *HttpServer) SendMessage(c *gin.Context) {
 	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
 	if !ok {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	uid := c.Query("delby")
-	userID, err := strconv.ParseUint(uid, 10, 64)
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
 	if err != nil {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
+	// the same limit as websocket frames
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, r.maxMessageSize)
+	var req SendMessagePresenter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			response(c, http.StatusRequestEntityTooLarge, ErrMessageTooLarge)
+			return
+		}
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var replyTo uint64
+	if req.ReplyTo != "" {
+		replyTo, err = strconv.ParseUint(req.ReplyTo, 10, 64)
+		if err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
 
 	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
 	if err != nil {
@@ -219,133 +478,1024 @@ func (r *HttpServer) DeleteChannel(c *gin.Context) {
 		return
 	}
 	if !exist {
-		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		response(c, http.StatusNotFound, ErrChannelOrUserNotFound)
 		return
 	}
-
-	err = r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, LeavedMessage)
+	allow, err := r.msgRateLimiter.Allow(c.Request.Context(), channelID, userID, req.Event)
 	if err != nil {
 		r.logger.Error(err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	err = r.chanSvc.DeleteChannel(c.Request.Context(), channelID)
+	if !allow {
+		response(c, http.StatusTooManyRequests, ErrRateLimited)
+		return
+	}
+
+	var msg *Message
+	encryption := req.Encryption.ToEncryption()
+	if req.Event == EventFile {
+		msg, err = r.msgSvc.BroadcastFileMessage(c.Request.Context(), channelID, userID, req.Payload, replyTo, req.IdempotencyKey, encryption)
+	} else {
+		msg, err = r.msgSvc.BroadcastTextMessage(c.Request.Context(), channelID, userID, req.Payload, replyTo, req.IdempotencyKey, encryption)
+	}
 	if err != nil {
-		r.logger.Error(err.Error())
-		response(c, http.StatusInternalServerError, common.ErrServer)
+		r.responseServiceError(c, err)
 		return
 	}
-	c.JSON(http.StatusNoContent, common.SuccessMessage{
-		Message: "ok",
-	})
+	c.JSON(http.StatusCreated, msg.ToPresenter())
 }
 
-func (r *HttpServer) HandleChatOnConnect(sess *melody.Session) {
-	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+// @Summary Search channel messages
+// @Description Full-text search over text messages of a channel, ranked by relevance
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param q query string true "search query"
+// @Param offset query int false "number of results to skip"
+// @Param limit query int false "max number of results"
+// @Success 200 {object} MessagesPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/search [get]
+func (r *HttpServer) SearchMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit <= 0 {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	msgs, hasMore, err := r.msgSvc.SearchMessages(c.Request.Context(), channelID, query, offset, limit)
 	if err != nil {
 		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	accessToken := sess.Request.URL.Query().Get("access_token")
-	authResult, err := common.Auth(&common.AuthPayload{
-		AccessToken: accessToken,
+	msgsPresenter := []MessagePresenter{}
+	for _, msg := range msgs {
+		msgsPresenter = append(msgsPresenter, *msg.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &MessagesPresenter{
+		HasMore:  hasMore,
+		Messages: msgsPresenter,
 	})
+}
+
+// @Summary Export channel transcript
+// @Description Stream the whole message history of a channel as a JSON document, newline-delimited JSON or a self-contained HTML page
+// @Tags chat
+// @Produce json,text/html
+// @param Authorization header string true "channel authorization"
+// @Param format query string false "json (default), ndjson or html"
+// @Success 200 {array} TranscriptMessagePresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/export [get]
+func (r *HttpServer) ExportMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	channelIDStr := strconv.FormatUint(channelID, 10)
+	writer, err := NewTranscriptWriter(c.Query("format"), c.Writer, channelIDStr)
 	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	c.Header("Content-Type", writer.ContentType())
+	c.Header("Content-Disposition", "attachment; filename=transcript-"+channelIDStr+"."+writer.FileExt())
+	c.Status(http.StatusOK)
+	if err := writer.WriteHeader(); err != nil {
 		r.logger.Error(err.Error())
+		return
 	}
-	if authResult.Expired {
-		r.logger.Error(common.ErrTokenExpired.Error())
+	if err := r.msgSvc.ExportMessages(c.Request.Context(), channelID, writer.WriteMessage); err != nil {
+		// the response has been partially written, so the transcript is left unterminated
+		r.logger.Error(err.Error())
+		return
 	}
-	channelID := authResult.ChannelID
-	err = r.initializeChatSession(sess, channelID, userID)
-	if err != nil {
+	if err := writer.WriteFooter(); err != nil {
 		r.logger.Error(err.Error())
+	}
+}
+
+// @Summary Get channel retention
+// @Description Get how long new messages in the channel are kept in seconds, where 0 means forever
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} RetentionPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/retention [get]
+func (r *HttpServer) GetChannelRetention(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	if err := r.msgSvc.BroadcastConnectMessage(context.Background(), channelID, userID); err != nil {
+	retentionSec, err := r.msgSvc.GetChannelRetention(c.Request.Context(), channelID)
+	if err != nil {
 		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
+	c.JSON(http.StatusOK, &RetentionPresenter{
+		RetentionSec: retentionSec,
+	})
 }
 
-func (r *HttpServer) initializeChatSession(sess *melody.Session, channelID, userID uint64) error {
-	ctx := context.Background()
-	if err := r.userSvc.AddOnlineUser(ctx, channelID, userID); err != nil {
-		return err
+// @Summary Set channel retention
+// @Description Set how long new messages in the channel are kept in seconds. Messages are removed once expired. Set 0 to use the default retention
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param retention body RetentionPresenter true "message retention"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/retention [put]
+func (r *HttpServer) SetChannelRetention(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
 	}
-	if err := r.forwardSvc.RegisterChannelSession(ctx, channelID, userID, r.msgSubscriber.subscriberID); err != nil {
-		return err
+	var req RetentionPresenter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
 	}
-	sess.Set(sessCidKey, channelID)
-	return nil
+	if err := r.msgSvc.SetChannelRetention(c.Request.Context(), channelID, req.RetentionSec); err != nil {
+		if errors.Is(err, ErrInvalidRetention) {
+			response(c, http.StatusBadRequest, ErrInvalidRetention)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
+	})
 }
 
-func (r *HttpServer) HandleChatOnMessage(sess *melody.Session, data []byte) {
-	msgPresenter, err := DecodeToMessagePresenter(data)
+// @Summary Get read receipts
+// @Description Get the last seen message and the unread message count of each channel member. Unread counts stop at 99, and unread_capped tells that there are more, to be shown as 99+
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} ReadReceiptsPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/unread [get]
+func (r *HttpServer) GetReadReceipts(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userIDs, err := r.userSvc.GetChannelMemberIDs(c.Request.Context(), channelID)
 	if err != nil {
 		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	msg, err := msgPresenter.ToMessage(sess.Request.URL.Query().Get("access_token"))
+	receipts, err := r.msgSvc.GetReadReceipts(c.Request.Context(), channelID, userIDs)
 	if err != nil {
 		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	switch msg.Event {
-	case EventText:
-		if err := r.msgSvc.BroadcastTextMessage(context.Background(), msg.ChannelID, msg.UserID, msg.Payload); err != nil {
-			r.logger.Error(err.Error())
-		}
-	case EventAction:
-		if err := r.msgSvc.BroadcastActionMessage(context.Background(), msg.ChannelID, msg.UserID, Action(msg.Payload)); err != nil {
-			r.logger.Error(err.Error())
-		}
-	case EventSeen:
-		messageID, err := strconv.ParseUint(msg.Payload, 10, 64)
-		if err != nil {
+	receiptsPresenter := []ReadReceiptPresenter{}
+	for _, receipt := range receipts {
+		receiptsPresenter = append(receiptsPresenter, *receipt.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &ReadReceiptsPresenter{
+		Receipts: receiptsPresenter,
+	})
+}
+
+// @Summary Get pinned messages
+// @Description Get the pinned messages of the channel, most recently pinned first
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} PinnedMessagesPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/pins [get]
+func (r *HttpServer) GetPinnedMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	pinnedMsgs, err := r.msgSvc.GetPinnedMessages(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	pinsPresenter := []PinnedMessagePresenter{}
+	for _, pinnedMsg := range pinnedMsgs {
+		pinsPresenter = append(pinsPresenter, *pinnedMsg.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &PinnedMessagesPresenter{
+		Pins: pinsPresenter,
+	})
+}
+
+// @Summary Get public keys
+// @Description Get the end-to-end encryption public keys published by the channel members
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} PublicKeysPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/keys [get]
+func (r *HttpServer) GetPublicKeys(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	keys, err := r.msgSvc.GetPublicKeys(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	keysPresenter := []PublicKeyPresenter{}
+	for _, key := range keys {
+		keysPresenter = append(keysPresenter, *key.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &PublicKeysPresenter{
+		Keys: keysPresenter,
+	})
+}
+
+// @Summary Delete channel
+// @Description Delete a channel
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param delby query string true "id of the user that performs the deletion"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel [delete]
+func (r *HttpServer) DeleteChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	uid := c.Query("delby")
+	userID, err := strconv.ParseUint(uid, 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return
+	}
+
+	err = r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, LeavedMessage)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	err = r.chanSvc.DeleteChannel(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
+	})
+}
+
+// @Summary Refresh channel access token
+// @Description Exchange a valid or recently expired access token of a channel for a new one. Each token can be exchanged only once, and exchanging a token again revokes all tokens refreshed from it
+// @Tags chat
+// @Accept json
+// @Produce json
+// @Param uid query string true "user id"
+// @Param token body RefreshTokenPresenter true "access token to refresh"
+// @Success 200 {object} ChannelTokenPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/token [post]
+func (r *HttpServer) RefreshChannelToken(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var req RefreshTokenPresenter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	channel, err := r.chanSvc.RefreshChannelToken(c.Request.Context(), req.AccessToken, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrInvalidToken):
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		case errors.Is(err, common.ErrTokenExpired):
+			response(c, http.StatusUnauthorized, common.ErrTokenExpired)
+		case errors.Is(err, common.ErrTokenRevoked):
+			response(c, http.StatusUnauthorized, common.ErrTokenRevoked)
+		case errors.Is(err, ErrTokenReused):
+			r.logger.Error(err.Error())
+			response(c, http.StatusUnauthorized, ErrTokenReused)
+		case errors.Is(err, ErrChannelOrUserNotFound):
+			response(c, http.StatusNotFound, ErrChannelOrUserNotFound)
+		default:
 			r.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, &ChannelTokenPresenter{
+		ChannelID:   strconv.FormatUint(channel.ID, 10),
+		AccessToken: channel.AccessToken,
+	})
+}
+
+// @Summary Get channel member limit
+// @Description Get the maximum number of members of a channel
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} MemberLimitPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/limit [get]
+func (r *HttpServer) GetChannelMemberLimit(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	maxMembers, err := r.userSvc.GetChannelMemberLimit(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, &MemberLimitPresenter{
+		MaxMembers: maxMembers,
+	})
+}
+
+// @Summary Set channel member limit
+// @Description Set the maximum number of members of a channel. The limit cannot be lower than the number of current members. Set 0 to use the default limit
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param limit body MemberLimitPresenter true "member limit"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/limit [put]
+func (r *HttpServer) SetChannelMemberLimit(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var req MemberLimitPresenter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if err := r.userSvc.SetChannelMemberLimit(c.Request.Context(), channelID, req.MaxMembers); err != nil {
+		if errors.Is(err, ErrInvalidMemberLimit) {
+			response(c, http.StatusBadRequest, ErrInvalidMemberLimit)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
+	})
+}
+
+// @Summary Invite channel member
+// @Description Add a user to the members of a channel. The invited user can then start a chat with the access token of the channel. A channel of a random match is limited to the matched pair, so invitations to it fail with 409
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param invby query string true "id of the member that sends the invitation"
+// @Param invitation body InvitationPresenter true "invited user"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/members [post]
+func (r *HttpServer) InviteChannelMember(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	inviterID, err := strconv.ParseUint(c.Query("invby"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var req InvitationPresenter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	userID, err := strconv.ParseUint(req.UserID, 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, inviterID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return
+	}
+	if _, err := r.userSvc.GetUser(c.Request.Context(), userID); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			response(c, http.StatusNotFound, ErrUserNotFound)
 			return
 		}
-		if err := r.msgSvc.MarkMessageSeen(context.Background(), msg.ChannelID, msg.UserID, messageID); err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	exist, err = r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !exist {
+		if err := r.userSvc.AddUserToChannel(c.Request.Context(), channelID, userID); err != nil {
+			if errors.Is(err, ErrChannelFull) {
+				response(c, http.StatusConflict, ErrChannelFull)
+				return
+			}
 			r.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
 		}
-	case EventFile:
-		if err := r.msgSvc.BroadcastFileMessage(context.Background(), msg.ChannelID, msg.UserID, msg.Payload); err != nil {
+		if err := r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, InvitedMessage); err != nil {
 			r.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
 		}
-	default:
-		r.logger.Error("invailid event type: " + strconv.Itoa(msg.Event))
 	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
+	})
 }
 
-func (r *HttpServer) HandleChatOnClose(sess *melody.Session, i int, s string) error {
-	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+// @Summary Leave channel
+// @Description Remove a user from the members of a channel and close the connections of the user to it. The channel is deleted when its last member leaves
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "id of the user that leaves"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/members [delete]
+func (r *HttpServer) LeaveChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
 	if err != nil {
 		r.logger.Error(err.Error())
-		return err
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
 	}
-	accessToken := sess.Request.URL.Query().Get("access_token")
-	authResult, err := common.Auth(&common.AuthPayload{
-		AccessToken: accessToken,
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return
+	}
+
+	remaining, err := r.userSvc.RemoveUserFromChannel(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if err := r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, LeftMessage); err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if remaining == 0 {
+		if err := r.chanSvc.DeleteChannel(c.Request.Context(), channelID); err != nil {
+			r.logger.Error(err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
 	})
+}
+
+func (r *HttpServer) HandleChatOnConnect(sess *melody.Session) {
+	channelID, userID, err := getSessionIdentity(sess)
+	if err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+	err = r.initializeChatSession(channelID, userID)
 	if err != nil {
 		r.logger.Error(err.Error())
+		return
+	}
+	if err := r.replayMessages(sess, channelID); err != nil {
+		r.logger.Error(err.Error())
+	}
+	if err := r.msgSvc.BroadcastConnectMessage(context.Background(), channelID, userID); err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+}
+
+func (r *HttpServer) initializeChatSession(channelID, userID uint64) error {
+	ctx := context.Background()
+	if err := r.userSvc.AddOnlineUser(ctx, channelID, userID); err != nil {
 		return err
 	}
-	if authResult.Expired {
-		r.logger.Error(common.ErrTokenExpired.Error())
-		return common.ErrTokenExpired
+	if err := r.forwardSvc.RegisterChannelSession(ctx, channelID, userID, r.msgSubscriber.subscriberID); err != nil {
+		return err
 	}
-	channelID := authResult.ChannelID
-	err = r.userSvc.DeleteOnlineUser(context.Background(), channelID, userID)
+	return nil
+}
+
+// replayMessages replays persisted messages to the session
+func (r *HttpServer) replayMessages(sess *melody.Session, channelID uint64) error {
+	dlv, exist := sess.Get(sessDlvKey)
+	if !exist {
+		return ErrSessionNotInitialized
+	}
+	return r.replay(dlv.(*sessionDelivery), channelID, func(msg *Message) {
+		if err := writeMessage(sess, msg); err != nil {
+			r.logger.Error(err.Error())
+		}
+	})
+}
+
+// replay sends persisted messages after the last message received by the client
+// before switching the delivery to live messages. Live messages are buffered meanwhile.
+// Both are capped to fit the session buffer, and the client is told with a replay truncated frame
+// to fetch the rest from message history if either cap is hit
+func (r *HttpServer) replay(delivery *sessionDelivery, channelID uint64, send func(*Message)) error {
+	hasMore, err := r.replayPersisted(delivery, channelID, send)
+	if delivery.finishReplay(send) {
+		hasMore = true
+	}
+	if hasMore {
+		send(r.newErrorMessage("", ErrReplayTruncated))
+	}
+	return err
+}
+func (r *HttpServer) replayPersisted(delivery *sessionDelivery, channelID uint64, send func(*Message)) (bool, error) {
+	afterID, replaying := delivery.replayFrom()
+	if !replaying {
+		return false, nil
+	}
+	msgs, hasMore, err := r.msgSvc.QueryMessages(context.Background(), channelID, &MessageQuery{
+		AfterID: afterID,
+		Limit:   r.maxReplayNum,
+		Asc:     true,
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, msg := range msgs {
+		delivery.replay(msg, send)
+	}
+	return hasMore, nil
+}
+
+// HandleChatOnMessage handles a frame sent by the session. A failed frame is answered with an error frame,
+// and a successful one with an ack frame if the client sets a correlation ID on it
+func (r *HttpServer) HandleChatOnMessage(sess *melody.Session, data []byte) {
+	sessChannelID, sessUserID, err := getSessionIdentity(sess)
+	if err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+	msgPresenter, err := getSessionCodec(sess).Decode(data)
+	if err != nil {
+		r.sendErrorMessage(sess, "", fmt.Errorf("error decode message frame: %w: %v", ErrInvalidFrame, err))
+		return
+	}
+	correlationID := msgPresenter.CorrelationID
+	msg, err := msgPresenter.ToMessage(sess.Request.URL.Query().Get("access_token"), sessUserID)
+	if err != nil {
+		r.sendErrorMessage(sess, correlationID, err)
+		return
+	}
+	allow, err := r.msgRateLimiter.Allow(context.Background(), msg.ChannelID, msg.UserID, msg.Event)
+	if err != nil {
+		r.sendErrorMessage(sess, correlationID, err)
+		return
+	}
+	if !allow {
+		r.throttleSession(sess, correlationID)
+		return
+	}
+	if err := r.checkSessionAccess(context.Background(), sessChannelID, getSessionAccess(sess)); err != nil {
+		r.closeUnauthorizedSession(sess, err)
+		return
+	}
+	var typing *typingThrottle
+	if throttle, exist := sess.Get(sessTypingKey); exist {
+		typing = throttle.(*typingThrottle)
+	}
+	messageID, err := r.handleMessage(msg, typing)
+	if err != nil {
+		r.sendErrorMessage(sess, correlationID, err)
+		return
+	}
+	if correlationID != "" {
+		r.sendAckMessage(sess, correlationID, messageID)
+	}
+}
+
+// handleMessage dispatches the message by its event, and returns the ID of the message it creates or targets.
+// Typing indicators are throttled if a throttle is given
+func (r *HttpServer) handleMessage(msg *Message, typing *typingThrottle) (uint64, error) {
+	switch msg.Event {
+	case EventText:
+		sent, err := r.msgSvc.BroadcastTextMessage(context.Background(), msg.ChannelID, msg.UserID, msg.Payload, msg.ReplyTo, msg.IdempotencyKey, msg.Encryption)
+		if err != nil {
+			return 0, err
+		}
+		return sent.MessageID, nil
+	case EventAction:
+		action := Action(msg.Payload)
+		if typing != nil && !typing.allow(action, time.Now()) {
+			return 0, nil
+		}
+		return 0, r.msgSvc.BroadcastActionMessage(context.Background(), msg.ChannelID, msg.UserID, action)
+	case EventSeen:
+		messageID, err := strconv.ParseUint(msg.Payload, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return messageID, r.msgSvc.MarkMessageSeen(context.Background(), msg.ChannelID, msg.UserID, messageID)
+	case EventFile:
+		sent, err := r.msgSvc.BroadcastFileMessage(context.Background(), msg.ChannelID, msg.UserID, msg.Payload, msg.ReplyTo, msg.IdempotencyKey, msg.Encryption)
+		if err != nil {
+			return 0, err
+		}
+		return sent.MessageID, nil
+	case EventEdit:
+		return msg.MessageID, r.msgSvc.EditMessage(context.Background(), msg.ChannelID, msg.UserID, msg.MessageID, msg.Payload, msg.Encryption)
+	case EventDelete:
+		return msg.MessageID, r.msgSvc.DeleteMessage(context.Background(), msg.ChannelID, msg.UserID, msg.MessageID)
+	case EventReaction:
+		reaction, err := DecodeToReaction([]byte(msg.Payload))
+		if err != nil {
+			return 0, fmt.Errorf("error decode reaction: %w: %v", ErrInvalidReaction, err)
+		}
+		return msg.MessageID, r.msgSvc.ReactMessage(context.Background(), msg.ChannelID, msg.UserID, msg.MessageID, reaction)
+	case EventKeyExchange:
+		key, err := DecodeToPublicKey([]byte(msg.Payload))
+		if err != nil {
+			return 0, fmt.Errorf("error decode public key: %w: %v", ErrInvalidPublicKey, err)
+		}
+		return 0, r.msgSvc.PublishPublicKey(context.Background(), msg.ChannelID, msg.UserID, key)
+	case EventPin:
+		return msg.MessageID, r.msgSvc.PinMessage(context.Background(), msg.ChannelID, msg.UserID, msg.MessageID)
+	case EventUnpin:
+		return msg.MessageID, r.msgSvc.UnpinMessage(context.Background(), msg.ChannelID, msg.UserID, msg.MessageID)
+	}
+	return 0, fmt.Errorf("error handle event %d: %w", msg.Event, ErrInvalidEvent)
+}
+
+func (r *HttpServer) HandleChatOnClose(sess *melody.Session, i int, s string) error {
+	channelID, userID, err := getSessionIdentity(sess)
 	if err != nil {
 		r.logger.Error(err.Error())
 		return err
 	}
-	err = r.forwardSvc.RemoveChannelSession(context.Background(), channelID, userID)
+	err = r.closeChatSession(channelID, userID)
 	if err != nil {
 		r.logger.Error(err.Error())
 		return err
 	}
-	return r.msgSvc.BroadcastActionMessage(context.Background(), channelID, userID, OfflineMessage)
+	return nil
+}
+
+// closeChatSession undoes initializeChatSession and tells the channel that the user is offline
+func (r *HttpServer) closeChatSession(channelID, userID uint64) error {
+	ctx := context.Background()
+	if err := r.userSvc.DeleteOnlineUser(ctx, channelID, userID); err != nil {
+		return err
+	}
+	if err := r.forwardSvc.RemoveChannelSession(ctx, channelID, userID); err != nil {
+		return err
+	}
+	return r.msgSvc.BroadcastActionMessage(ctx, channelID, userID, OfflineMessage)
+}
+
+// checkSessionAccess checks that the token an open session was authorized with has not been revoked,
+// and returns common.ErrTokenRevoked if its channel or its token family has been revoked.
+// Membership is not checked, since sessions of a user that has left are closed by the left message.
+// A token found unrevoked is trusted for accessCheckInterval, so a burst of frames costs one check
+func (r *HttpServer) checkSessionAccess(ctx context.Context, channelID uint64, access *sessionAccess) error {
+	now := time.Now()
+	if access.checkedWithin(now, accessCheckInterval) {
+		return nil
+	}
+	revoked, err := r.chanSvc.IsTokenRevoked(ctx, channelID, access.family)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return common.ErrTokenRevoked
+	}
+	access.markChecked(now)
+	return nil
+}
+
+// accessCheckInterval bounds how long a session keeps sending frames after its token family is revoked
+const accessCheckInterval = time.Second
+
+// sessionAccess remembers the token family of a session and when its token was last found unrevoked
+type sessionAccess struct {
+	mu        sync.Mutex
+	family    string
+	checkedAt time.Time
+}
+
+func newSessionAccess(family string) *sessionAccess {
+	return &sessionAccess{
+		family: family,
+	}
+}
+
+func (a *sessionAccess) checkedWithin(now time.Time, interval time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return now.Sub(a.checkedAt) < interval
+}
+
+func (a *sessionAccess) markChecked(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checkedAt = now
+}
+
+// closeUnauthorizedSession closes a session that is no longer allowed in its channel.
+// The session is kept open on internal errors so that a redis hiccup does not disconnect everyone
+func (r *HttpServer) closeUnauthorizedSession(sess *melody.Session, err error) {
+	if !isAccessDenied(err) {
+		r.sendErrorMessage(sess, "", err)
+		return
+	}
+	if err := sess.CloseWithMsg(melody.FormatCloseMessage(melody.ClosePolicyViolation, err.Error())); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+
+// closeUnauthorizedStream closes a stream that is no longer allowed in its channel, the same as closeUnauthorizedSession
+func (r *HttpServer) closeUnauthorizedStream(conn *streamConn, err error) {
+	if isAccessDenied(err) {
+		conn.close()
+	}
+}
+
+// isAccessDenied reports whether the error of checkSessionAccess means that the session must be closed
+func isAccessDenied(err error) bool {
+	return errors.Is(err, common.ErrTokenRevoked)
+}
+
+// throttleSession tells the session that its frame is dropped, and disconnects it if it keeps exceeding the limits
+func (r *HttpServer) throttleSession(sess *melody.Session, correlationID string) {
+	tracker, exist := sess.Get(sessViolationKey)
+	if exist && tracker.(*violationTracker).record(time.Now()) {
+		if err := sess.CloseWithMsg(melody.FormatCloseMessage(melody.ClosePolicyViolation, ErrRateLimited.Error())); err != nil {
+			r.logger.Error(err.Error())
+		}
+		return
+	}
+	r.sendErrorMessage(sess, correlationID, ErrRateLimited)
+}
+
+// sendErrorMessage reports the error of a frame to the session
+func (r *HttpServer) sendErrorMessage(sess *melody.Session, correlationID string, err error) {
+	if err := writeMessage(sess, r.newErrorMessage(correlationID, err)); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+
+// sendAckMessage confirms a successful frame to the session with the ID of the message it creates or targets
+func (r *HttpServer) sendAckMessage(sess *melody.Session, correlationID string, messageID uint64) {
+	if err := writeMessage(sess, newAckMessage(correlationID, messageID)); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+
+// newErrorMessage returns the error frame of a failed frame. Internal errors are logged
+// and only reported as a server error
+func (r *HttpServer) newErrorMessage(correlationID string, err error) *Message {
+	code, payload := getErrorFrame(err)
+	if code == CodeInternal {
+		r.logger.Error(err.Error())
+	}
+	return &Message{
+		Event:         EventError,
+		Payload:       payload,
+		Time:          time.Now().UnixMilli(),
+		Code:          code,
+		CorrelationID: correlationID,
+	}
+}
+
+// responseServiceError responds with the status and the client-facing message of a message service error,
+// the same as the error frame of a websocket
+func (r *HttpServer) responseServiceError(c *gin.Context, err error) {
+	code, message := getErrorFrame(err)
+	if code == CodeInternal {
+		r.logger.Error(err.Error())
+	}
+	c.JSON(getErrorStatus(code), common.ErrResponse{
+		Message: message,
+	})
+}
+
+// respondErrorMessage answers a frame sent over http with its error frame
+func (r *HttpServer) respondErrorMessage(c *gin.Context, correlationID string, err error) {
+	msg := r.newErrorMessage(correlationID, err)
+	c.JSON(getErrorStatus(msg.Code), msg.ToPresenter())
+}
+
+func newAckMessage(correlationID string, messageID uint64) *Message {
+	return &Message{
+		MessageID:     messageID,
+		Event:         EventAck,
+		Time:          time.Now().UnixMilli(),
+		CorrelationID: correlationID,
+	}
+}
+
+// getSessionIdentity returns the channel and user bound to the session when the websocket was upgraded
+func getSessionIdentity(sess *melody.Session) (uint64, uint64, error) {
+	cid, exist := sess.Get(sessCidKey)
+	if !exist {
+		return 0, 0, ErrSessionNotInitialized
+	}
+	uid, exist := sess.Get(sessUidKey)
+	if !exist {
+		return 0, 0, ErrSessionNotInitialized
+	}
+	return cid.(uint64), uid.(uint64), nil
+}
+
+// getSessionAccess returns the access check state of the session
+func getSessionAccess(sess *melody.Session) *sessionAccess {
+	access, exist := sess.Get(sessAccessKey)
+	if !exist {
+		return newSessionAccess("")
+	}
+	return access.(*sessionAccess)
+}
+
+// parseMessageQuery parses the range query parameters of message listing.
+// It reports false if none of them is given
+func parseMessageQuery(c *gin.Context) (*MessageQuery, bool, error) {
+	var query MessageQuery
+	isRangeQuery := false
+	if before := c.Query("before"); before != "" {
+		beforeID, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		query.BeforeID = beforeID
+		isRangeQuery = true
+	}
+	if after := c.Query("after"); after != "" {
+		afterID, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		query.AfterID = afterID
+		isRangeQuery = true
+	}
+	if since := c.Query("since"); since != "" {
+		sinceMs, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		if afterID := common.SonyFlakeLowerBoundID(time.UnixMilli(sinceMs)); afterID > 0 && afterID-1 > query.AfterID {
+			query.AfterID = afterID - 1
+		}
+		isRangeQuery = true
+	}
+	if until := c.Query("until"); until != "" {
+		untilMs, err := strconv.ParseInt(until, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		// sonyflake time unit is 10 msec, so round up to the next unit to include the whole millisecond
+		beforeID := common.SonyFlakeLowerBoundID(time.UnixMilli(untilMs).Add(10 * time.Millisecond))
+		if query.BeforeID == 0 || beforeID < query.BeforeID {
+			query.BeforeID = beforeID
+		}
+		isRangeQuery = true
+	}
+	if limit := c.Query("limit"); limit != "" {
+		limitNum, err := strconv.Atoi(limit)
+		if err != nil || limitNum <= 0 {
+			return nil, false, common.ErrInvalidParam
+		}
+		query.Limit = limitNum
+		isRangeQuery = true
+	}
+	switch c.Query("order") {
+	case "":
+	case "asc":
+		query.Asc = true
+		isRangeQuery = true
+	case "desc":
+		isRangeQuery = true
+	default:
+		return nil, false, common.ErrInvalidParam
+	}
+	return &query, isRangeQuery, nil
 }
@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gin-gonic/gin"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"gopkg.in/olahol/melody.v1"
+)
+
+func newTestHttpServer(t *testing.T, chanSvc ChannelService) *HttpServer {
+	gin.SetMode(gin.TestMode)
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	server := &HttpServer{
+		logger:        newTestLogger(),
+		svr:           gin.New(),
+		mc:            MelodyChatConn{melody.New()},
+		msgSubscriber: &MessageSubscriber{router: router},
+		chanSvc:       chanSvc,
+	}
+	server.RegisterRoutes()
+	return server
+}
+
+func TestRevokedTokenFamilyIsUnauthorized(t *testing.T) {
+	common.JwtSecret = "secret"
+	common.JwtExpirationSecond = 60
+	chanRepo := NewChannelRepoCacheImpl(newFakeRedisCache(), nil)
+	server := newTestHttpServer(t, NewChannelServiceImpl(newTestLogger(), chanRepo, nil, nil, nil))
+
+	accessToken, err := common.NewJWT(1)
+	if err != nil {
+		t.Fatalf("new token: %v", err)
+	}
+	claims, err := common.ParseRefreshableJWT(accessToken)
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	// a token refreshed from the first one belongs to the same family and is revoked with it
+	refreshedToken, err := common.NewRefreshedJWT(1, claims.Family)
+	if err != nil {
+		t.Fatalf("refresh token: %v", err)
+	}
+	if err := chanRepo.RevokeTokenFamily(context.Background(), claims.Family, time.Minute); err != nil {
+		t.Fatalf("revoke token family: %v", err)
+	}
+
+	for _, token := range []string{accessToken, refreshedToken} {
+		req := httptest.NewRequest(http.MethodGet, "/api/chat/channel/messages", nil)
+		req.Header.Set(common.JWTAuthHeader, "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.svr.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+		var resp common.ErrResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if resp.Message != common.ErrTokenRevoked.Error() {
+			t.Fatalf("message %q, want %q", resp.Message, common.ErrTokenRevoked.Error())
+		}
+	}
+}
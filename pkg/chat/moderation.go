@@ -0,0 +1,378 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ModerationVerdict is what a message filter decides to do with a message
+type ModerationVerdict int
+
+const (
+	VerdictAllow ModerationVerdict = iota
+	VerdictMask
+	VerdictReject
+)
+
+var verdictNames = map[ModerationVerdict]string{
+	VerdictAllow:  "allow",
+	VerdictMask:   "mask",
+	VerdictReject: "reject",
+}
+
+func (v ModerationVerdict) String() string {
+	return verdictNames[v]
+}
+
+// ModerationDecision is the decision of a message filter.
+// Text replaces the message text when the verdict is VerdictMask,
+// and Reason is sent back to the sender when the verdict is VerdictReject
+type ModerationDecision struct {
+	Verdict ModerationVerdict
+	Text    string
+	Reason  string
+}
+
+// MessageFilter inspects the text of a message before it is stored and delivered.
+// Outside classifiers are plugged into the pipeline by implementing it
+type MessageFilter interface {
+	Name() string
+	Filter(ctx context.Context, msg *Message, text string) (*ModerationDecision, error)
+}
+
+// ModerationError is returned when a filter rejects a message
+type ModerationError struct {
+	Filter string
+	Reason string
+}
+
+func (e *ModerationError) Error() string {
+	return common.Join(ErrMessageRejected.Error(), ": ", e.Reason)
+}
+
+func (e *ModerationError) Unwrap() error {
+	return ErrMessageRejected
+}
+
+// MessageModerator runs text and file messages through a chain of filters.
+// A filter that fails lets the message through, so moderation never blocks the chat
+type MessageModerator struct {
+	logger    common.HttpLog
+	filters   []MessageFilter
+	decisions *prometheus.CounterVec
+}
+
+func NewMessageModerator(name string, logger common.HttpLog, config *config.Config) *MessageModerator {
+	moderation := config.Chat.Moderation
+	var filters []MessageFilter
+	if words := splitList(moderation.WordList); len(words) > 0 {
+		filters = append(filters, NewWordListFilter(words, moderation.WordListReject))
+	}
+	if moderation.MaxLinks > 0 || moderation.MaxRepeatedChars > 0 || moderation.BlockedDomains != "" {
+		filters = append(filters, NewLinkSpamFilter(moderation.MaxLinks, moderation.MaxRepeatedChars, splitList(moderation.BlockedDomains)))
+	}
+	if moderation.Classifier.Url != "" {
+		filters = append(filters, NewHttpClassifierFilter(moderation.Classifier.Url, time.Duration(moderation.Classifier.TimeoutMs)*time.Millisecond))
+	}
+	return &MessageModerator{
+		logger:  logger,
+		filters: filters,
+		decisions: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   name,
+			Name:        "chat_moderation_decisions_total",
+			Help:        "Total number of moderation decisions made by each message filter.",
+			ConstLabels: prometheus.Labels{"serviceID": name},
+		}, []string{"filter", "verdict"}),
+	}
+}
+
+// Moderate runs the message through the filters and applies the masked text to its payload.
+// It returns a ModerationError if any filter rejects the message.
+// End-to-end encrypted messages are let through since their ciphertext cannot be inspected
+func (m *MessageModerator) Moderate(ctx context.Context, msg *Message) error {
+	if len(m.filters) == 0 {
+		return nil
+	}
+	if msg.Encryption != nil {
+		m.decisions.WithLabelValues("pipeline", "skipped").Inc()
+		return nil
+	}
+	var file FilePayload
+	text := msg.Payload
+	if msg.Event == EventFile {
+		if err := json.Unmarshal([]byte(msg.Payload), &file); err != nil {
+			return fmt.Errorf("error decode file payload: %w", err)
+		}
+		text = file.FileName
+	}
+	masked := false
+	for _, filter := range m.filters {
+		decision, err := filter.Filter(ctx, msg, text)
+		if err != nil {
+			m.decisions.WithLabelValues(filter.Name(), "error").Inc()
+			m.logger.Error(fmt.Sprintf("error moderate message by filter %s: %v", filter.Name(), err))
+			continue
+		}
+		m.decisions.WithLabelValues(filter.Name(), decision.Verdict.String()).Inc()
+		switch decision.Verdict {
+		case VerdictMask:
+			text = decision.Text
+			masked = true
+		case VerdictReject:
+			return &ModerationError{
+				Filter: filter.Name(),
+				Reason: decision.Reason,
+			}
+		}
+	}
+	if !masked {
+		return nil
+	}
+	if msg.Event == EventFile {
+		file.FileName = text
+		payload, err := json.Marshal(&file)
+		if err != nil {
+			return fmt.Errorf("error encode file payload: %w", err)
+		}
+		msg.Payload = string(payload)
+		return nil
+	}
+	msg.Payload = text
+	return nil
+}
+
+// WordListFilter masks or rejects messages containing banned words, case-insensitively
+type WordListFilter struct {
+	pattern *regexp.Regexp
+	reject  bool
+}
+
+var asciiWordPattern = regexp.MustCompile(`^\w+$`)
+
+func NewWordListFilter(words []string, reject bool) *WordListFilter {
+	alternatives := make([]string, len(words))
+	for i, word := range words {
+		alternative := regexp.QuoteMeta(word)
+		// word boundaries only make sense for words made of ASCII word characters
+		if asciiWordPattern.MatchString(word) {
+			alternative = `\b` + alternative + `\b`
+		}
+		alternatives[i] = alternative
+	}
+	return &WordListFilter{
+		pattern: regexp.MustCompile(`(?i)(?:` + strings.Join(alternatives, "|") + `)`),
+		reject:  reject,
+	}
+}
+
+func (f *WordListFilter) Name() string {
+	return "wordlist"
+}
+
+func (f *WordListFilter) Filter(ctx context.Context, msg *Message, text string) (*ModerationDecision, error) {
+	if !f.pattern.MatchString(text) {
+		return &ModerationDecision{Verdict: VerdictAllow}, nil
+	}
+	if f.reject {
+		return &ModerationDecision{
+			Verdict: VerdictReject,
+			Reason:  "message contains banned words",
+		}, nil
+	}
+	return &ModerationDecision{
+		Verdict: VerdictMask,
+		Text: f.pattern.ReplaceAllStringFunc(text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		}),
+	}, nil
+}
+
+// LinkSpamFilter rejects messages that carry too many links, link to blocked domains
+// or repeat the same character too many times in a row. A non-positive maximum disables its check
+type LinkSpamFilter struct {
+	maxLinks         int
+	maxRepeatedChars int
+	blockedDomains   []string
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+func NewLinkSpamFilter(maxLinks, maxRepeatedChars int, blockedDomains []string) *LinkSpamFilter {
+	domains := make([]string, len(blockedDomains))
+	for i, domain := range blockedDomains {
+		domains[i] = strings.ToLower(strings.TrimPrefix(domain, "."))
+	}
+	return &LinkSpamFilter{
+		maxLinks:         maxLinks,
+		maxRepeatedChars: maxRepeatedChars,
+		blockedDomains:   domains,
+	}
+}
+
+func (f *LinkSpamFilter) Name() string {
+	return "linkspam"
+}
+
+func (f *LinkSpamFilter) Filter(ctx context.Context, msg *Message, text string) (*ModerationDecision, error) {
+	links := linkPattern.FindAllString(text, -1)
+	if f.maxLinks > 0 && len(links) > f.maxLinks {
+		return &ModerationDecision{
+			Verdict: VerdictReject,
+			Reason:  "message contains too many links",
+		}, nil
+	}
+	for _, link := range links {
+		if f.isBlocked(link) {
+			return &ModerationDecision{
+				Verdict: VerdictReject,
+				Reason:  "message links to a blocked domain",
+			}, nil
+		}
+	}
+	if f.maxRepeatedChars > 0 && longestRun(text) > f.maxRepeatedChars {
+		return &ModerationDecision{
+			Verdict: VerdictReject,
+			Reason:  "message repeats the same character too many times",
+		}, nil
+	}
+	return &ModerationDecision{Verdict: VerdictAllow}, nil
+}
+
+func (f *LinkSpamFilter) isBlocked(link string) bool {
+	if len(f.blockedDomains) == 0 {
+		return false
+	}
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range f.blockedDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// longestRun returns the length of the longest run of the same character
+func longestRun(text string) int {
+	longest, run := 0, 0
+	var prev rune
+	for i, r := range []rune(text) {
+		if i > 0 && r == prev {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = r
+	}
+	return longest
+}
+
+// HttpClassifierFilter asks an outside classification service to moderate messages.
+// The service receives a ClassifierRequest as JSON and answers with a ClassifierResponse
+type HttpClassifierFilter struct {
+	url    string
+	client *http.Client
+}
+
+type ClassifierRequest struct {
+	ChannelID uint64 `json:"channel_id,string"`
+	UserID    uint64 `json:"user_id,string"`
+	Event     int    `json:"event"`
+	Text      string `json:"text"`
+}
+
+// ClassifierResponse is the decision of the classification service.
+// Verdict is one of "allow", "mask" or "reject"
+type ClassifierResponse struct {
+	Verdict string `json:"verdict"`
+	Text    string `json:"text"`
+	Reason  string `json:"reason"`
+}
+
+func NewHttpClassifierFilter(url string, timeout time.Duration) *HttpClassifierFilter {
+	return &HttpClassifierFilter{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (f *HttpClassifierFilter) Name() string {
+	return "classifier"
+}
+
+func (f *HttpClassifierFilter) Filter(ctx context.Context, msg *Message, text string) (*ModerationDecision, error) {
+	body, err := json.Marshal(&ClassifierRequest{
+		ChannelID: msg.ChannelID,
+		UserID:    msg.UserID,
+		Event:     msg.Event,
+		Text:      text,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error call classifier: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error call classifier: unexpected status %d", resp.StatusCode)
+	}
+	var result ClassifierResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decode classifier response: %w", err)
+	}
+	switch result.Verdict {
+	case VerdictAllow.String():
+		return &ModerationDecision{Verdict: VerdictAllow}, nil
+	case VerdictMask.String():
+		return &ModerationDecision{Verdict: VerdictMask, Text: result.Text}, nil
+	case VerdictReject.String():
+		reason := result.Reason
+		if reason == "" {
+			reason = "message flagged by classifier"
+		}
+		return &ModerationDecision{Verdict: VerdictReject, Reason: reason}, nil
+	}
+	return nil, fmt.Errorf("error unknown classifier verdict %q", result.Verdict)
+}
+
+// splitList splits a comma-separated config value and drops empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -2,25 +2,46 @@ package chat
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/minghsu0107/go-random-chat/pkg/infra"
 	"gopkg.in/olahol/melody.v1"
 )
 
+const (
+	resubscribeBaseDelay = 100 * time.Millisecond
+	resubscribeMaxDelay  = 10 * time.Second
+)
+
 type MessageSubscriber struct {
+	logger       common.HttpLog
 	subscriberID string
 	router       *message.Router
 	sub          message.Subscriber
+	r            infra.RedisCache
 	m            MelodyChatConn
+	streams      *StreamHub
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
-func NewMessageSubscriber(name string, router *message.Router, config *config.Config, sub message.Subscriber, m MelodyChatConn) (*MessageSubscriber, error) {
+func NewMessageSubscriber(name string, logger common.HttpLog, router *message.Router, config *config.Config, sub message.Subscriber, r infra.RedisCache, m MelodyChatConn, streams *StreamHub) (*MessageSubscriber, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &MessageSubscriber{
+		logger:       logger,
 		subscriberID: config.Chat.Subscriber.Id,
 		router:       router,
 		sub:          sub,
+		r:            r,
 		m:            m,
+		streams:      streams,
+		ctx:          ctx,
+		cancel:       cancel,
 	}, nil
 }
 
@@ -32,6 +53,16 @@ func (s *MessageSubscriber) HandleMessage(msg *message.Message) error {
 	return s.sendMessage(context.Background(), message)
 }
 
+// HandleEphemeralMessage delivers a message received from redis pub/sub.
+// Ephemeral messages are best effort, so malformed ones are dropped
+func (s *MessageSubscriber) HandleEphemeralMessage(payload string) {
+	message, err := DecodeToMessage([]byte(payload))
+	if err != nil {
+		return
+	}
+	_ = s.sendMessage(context.Background(), message)
+}
+
 func (s *MessageSubscriber) RegisterHandler() {
 	s.router.AddNoPublisherHandler(
 		"randomchat_message_handler",
@@ -41,20 +72,195 @@ func (s *MessageSubscriber) RegisterHandler() {
 	)
 }
 
+// Run consumes durable messages from kafka and ephemeral messages from redis pub/sub
+// until the kafka router stops. A lost pub/sub subscription only drops ephemeral messages,
+// so it is resubscribed in the background instead of stopping the subscriber
 func (s *MessageSubscriber) Run() error {
+	go s.runEphemeral()
 	return s.router.Run(context.Background())
 }
 
+// runEphemeral subscribes to ephemeral messages until the subscriber is stopped,
+// resubscribing with exponential backoff whenever the subscription ends
+func (s *MessageSubscriber) runEphemeral() {
+	delay := resubscribeBaseDelay
+	for {
+		start := time.Now()
+		err := s.r.Subscribe(s.ctx, EphemeralPubTopic, s.HandleEphemeralMessage)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("error subscribe to ephemeral messages: %v", err))
+		}
+		// a subscription that lasted a while is not part of a failure streak
+		if time.Since(start) > resubscribeMaxDelay {
+			delay = resubscribeBaseDelay
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > resubscribeMaxDelay {
+			delay = resubscribeMaxDelay
+		}
+	}
+}
+
 func (s *MessageSubscriber) GracefulStop() error {
+	s.cancel()
 	return s.router.Close()
 }
 
+// sendMessage broadcasts the message to sessions of its channel, encoded with the codec of each session,
+// and to server-sent event connections of its channel
 func (s *MessageSubscriber) sendMessage(ctx context.Context, message *Message) error {
-	return s.m.BroadcastFilter(message.ToPresenter().Encode(), func(sess *melody.Session) bool {
+	s.streams.Broadcast(message)
+	for _, codec := range messageCodecs {
+		data, err := codec.Encode(message)
+		if err != nil {
+			return err
+		}
+		filter := s.sessionFilter(message, codec)
+		if codec.Binary() {
+			err = s.m.BroadcastBinaryFilter(data, filter)
+		} else {
+			err = s.m.BroadcastFilter(data, filter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if message.Event == EventAction {
+		switch Action(message.Payload) {
+		case LeavedMessage:
+			s.streams.CloseChannel(message.ChannelID)
+			return s.closeChannelSessions(message.ChannelID)
+		case LeftMessage:
+			s.streams.CloseUser(message.ChannelID, message.UserID)
+			return s.closeUserSessions(message.ChannelID, message.UserID)
+		}
+	}
+	return nil
+}
+
+// closeUserSessions closes local sessions of a user that left the channel, after the messages broadcast before it
+func (s *MessageSubscriber) closeUserSessions(channelID, userID uint64) error {
+	return s.m.BroadcastFilter(nil, func(sess *melody.Session) bool {
+		cid, uid, err := getSessionIdentity(sess)
+		if err == nil && cid == channelID && uid == userID {
+			_ = sess.Close()
+		}
+		return false
+	})
+}
+
+// closeChannelSessions closes local sessions of a deleted channel. It goes through the broadcast queue,
+// so the sessions are closed after the messages broadcast before it are written
+func (s *MessageSubscriber) closeChannelSessions(channelID uint64) error {
+	return s.m.BroadcastFilter(nil, func(sess *melody.Session) bool {
+		cid, exist := sess.Get(sessCidKey)
+		if exist && cid.(uint64) == channelID {
+			_ = sess.Close()
+		}
+		return false
+	})
+}
+
+func (s *MessageSubscriber) sessionFilter(message *Message, codec MessageCodec) func(*melody.Session) bool {
+	return func(sess *melody.Session) bool {
 		channelID, exist := sess.Get(sessCidKey)
 		if !exist {
 			return false
 		}
-		return message.ChannelID == (channelID.(uint64))
-	})
+		if message.ChannelID != (channelID.(uint64)) {
+			return false
+		}
+		if getSessionCodec(sess) != codec {
+			return false
+		}
+		dlv, exist := sess.Get(sessDlvKey)
+		if !exist {
+			return true
+		}
+		return dlv.(*sessionDelivery).accept(message)
+	}
+}
+
+// sessionDelivery tracks the messages replayed to a session on reconnection,
+// so that the same messages arriving from live delivery are dropped
+type sessionDelivery struct {
+	mu            sync.Mutex
+	replaying     bool
+	buffered      []*Message
+	truncated     bool
+	lastMessageID uint64
+	replayed      map[uint64]struct{}
+}
+
+func newSessionDelivery(lastMessageID uint64) *sessionDelivery {
+	return &sessionDelivery{
+		replaying:     lastMessageID != 0,
+		lastMessageID: lastMessageID,
+		replayed:      make(map[uint64]struct{}),
+	}
+}
+
+func (d *sessionDelivery) replayFrom() (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastMessageID, d.replaying
+}
+
+// accept reports whether a live message should be sent to the session right away.
+// Live messages are buffered while the session is replaying
+func (d *sessionDelivery) accept(msg *Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.replaying {
+		// drop live messages beyond the cap, which the client fetches from message history instead
+		if len(d.buffered) < maxBufferedNum {
+			d.buffered = append(d.buffered, msg)
+		} else {
+			d.truncated = true
+		}
+		return false
+	}
+	return !d.isReplayed(msg)
+}
+
+func (d *sessionDelivery) replay(msg *Message, send func(*Message)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isReplayed(msg) {
+		return
+	}
+	d.replayed[msg.MessageID] = struct{}{}
+	send(msg)
+}
+
+// finishReplay flushes buffered live messages and switches the session to live delivery.
+// It reports whether any live message was dropped during the replay
+func (d *sessionDelivery) finishReplay(send func(*Message)) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, msg := range d.buffered {
+		if !d.isReplayed(msg) {
+			send(msg)
+		}
+	}
+	d.buffered = nil
+	d.replaying = false
+	return d.truncated
+}
+
+// isReplayed must be called with the lock held
+func (d *sessionDelivery) isReplayed(msg *Message) bool {
+	if msg.Event != EventText && msg.Event != EventFile {
+		return false
+	}
+	_, ok := d.replayed[msg.MessageID]
+	return ok
 }
@@ -8,12 +8,51 @@ import (
 )
 
 type MessagePresenter struct {
+	MessageID string           `json:"message_id"`
+	Event     int              `json:"event"`
+	UserID    string           `json:"user_id"`
+	Payload   string           `json:"payload"`
+	Seen      bool             `json:"seen"`
+	SeenBy    int              `json:"seen_by"`
+	Time      int64            `json:"time"`
+	EditedAt  int64            `json:"edited_at"`
+	Deleted   bool             `json:"deleted"`
+	Reactions map[string]int64 `json:"reactions"`
+	ReplyTo   string           `json:"reply_to"`
+	Quote     *QuotePresenter  `json:"quote"`
+	ExpireAt  int64            `json:"expire_at"`
+
+	Encryption     *EncryptionPresenter `json:"encryption,omitempty"`
+	Code           string               `json:"code,omitempty"`
+	CorrelationID  string               `json:"correlation_id,omitempty"`
+	IdempotencyKey string               `json:"idempotency_key,omitempty"`
+}
+
+type QuotePresenter struct {
 	MessageID string `json:"message_id"`
 	Event     int    `json:"event"`
 	UserID    string `json:"user_id"`
 	Payload   string `json:"payload"`
-	Seen      bool   `json:"seen"`
-	Time      int64  `json:"time"`
+	Deleted   bool   `json:"deleted"`
+
+	Encryption *EncryptionPresenter `json:"encryption,omitempty"`
+}
+
+type EncryptionPresenter struct {
+	Algorithm string `json:"alg"`
+	Nonce     string `json:"nonce"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+type PublicKeyPresenter struct {
+	UserID    string `json:"user_id"`
+	Algorithm string `json:"alg"`
+	Key       string `json:"key"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type PublicKeysPresenter struct {
+	Keys []PublicKeyPresenter `json:"keys"`
 }
 
 type UserPresenter struct {
@@ -27,15 +66,94 @@ type UserIDsPresenter struct {
 
 type MessagesPresenter struct {
 	NextPageState string             `json:"next_ps"`
+	HasMore       bool               `json:"has_more"`
 	Messages      []MessagePresenter `json:"messages"`
 }
 
+type ReadReceiptPresenter struct {
+	UserID            string `json:"user_id"`
+	LastSeenMessageID string `json:"last_seen_mid"`
+	UnreadCount       int64  `json:"unread_count"`
+	UnreadCapped      bool   `json:"unread_capped"`
+}
+
+type ReadReceiptsPresenter struct {
+	Receipts []ReadReceiptPresenter `json:"receipts"`
+}
+
+type PinnedMessagePresenter struct {
+	Message  MessagePresenter `json:"message"`
+	PinnedBy string           `json:"pinned_by"`
+	PinnedAt int64            `json:"pinned_at"`
+}
+
+type PinnedMessagesPresenter struct {
+	Pins []PinnedMessagePresenter `json:"pins"`
+}
+
+type RetentionPresenter struct {
+	RetentionSec int64 `json:"retention_sec" binding:"gte=0"`
+}
+
+type RefreshTokenPresenter struct {
+	AccessToken string `json:"access_token" binding:"required"`
+}
+
+type ChannelTokenPresenter struct {
+	ChannelID   string `json:"channel_id"`
+	AccessToken string `json:"access_token"`
+}
+
+type MemberLimitPresenter struct {
+	MaxMembers int `json:"max_members" binding:"gte=0"`
+}
+
+// SendMessagePresenter is a text or file message posted over http
+type SendMessagePresenter struct {
+	Event          int                  `json:"event" binding:"oneof=0 3"`
+	Payload        string               `json:"payload" binding:"required"`
+	ReplyTo        string               `json:"reply_to"`
+	IdempotencyKey string               `json:"idempotency_key"`
+	Encryption     *EncryptionPresenter `json:"encryption"`
+}
+
+type InvitationPresenter struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+type TranscriptMessagePresenter struct {
+	MessageID string `json:"message_id"`
+	Event     int    `json:"event"`
+	UserID    string `json:"user_id"`
+	UserName  string `json:"user_name"`
+	Payload   string `json:"payload"`
+	FileName  string `json:"file_name,omitempty"`
+	FileURL   string `json:"file_url,omitempty"`
+	Time      int64  `json:"time"`
+	EditedAt  int64  `json:"edited_at"`
+	Deleted   bool   `json:"deleted"`
+	ReplyTo   string `json:"reply_to"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// ToEncryption returns nil for a plaintext payload
+func (e *EncryptionPresenter) ToEncryption() *Encryption {
+	if e == nil {
+		return nil
+	}
+	return &Encryption{
+		Algorithm: e.Algorithm,
+		Nonce:     e.Nonce,
+		KeyID:     e.KeyID,
+	}
+}
+
 func (m *MessagePresenter) Encode() []byte {
 	result, _ := json.Marshal(m)
 	return result
 }
 
-func (m *MessagePresenter) ToMessage(accessToken string) (*Message, error) {
+func (m *MessagePresenter) ToMessage(accessToken string, sessUserID uint64) (*Message, error) {
 	authResult, err := common.Auth(&common.AuthPayload{
 		AccessToken: accessToken,
 	})
@@ -45,16 +163,42 @@ func (m *MessagePresenter) ToMessage(accessToken string) (*Message, error) {
 	if authResult.Expired {
 		return nil, common.ErrTokenExpired
 	}
-	channelID := authResult.ChannelID
+	return m.toMessage(authResult.ChannelID, sessUserID)
+}
+
+// toMessage converts the frame of the authenticated channel and user
+func (m *MessagePresenter) toMessage(channelID, sessUserID uint64) (*Message, error) {
 	userID, err := strconv.ParseUint(m.UserID, 10, 64)
 	if err != nil {
 		return nil, err
 	}
+	if userID != sessUserID {
+		return nil, ErrSenderMismatch
+	}
+	var messageID uint64
+	if m.MessageID != "" {
+		messageID, err = strconv.ParseUint(m.MessageID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var replyTo uint64
+	if m.ReplyTo != "" {
+		replyTo, err = strconv.ParseUint(m.ReplyTo, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &Message{
-		Event:     m.Event,
-		ChannelID: channelID,
-		UserID:    userID,
-		Payload:   m.Payload,
-		Time:      m.Time,
+		MessageID:      messageID,
+		ReplyTo:        replyTo,
+		Event:          m.Event,
+		ChannelID:      channelID,
+		UserID:         userID,
+		Payload:        m.Payload,
+		Time:           m.Time,
+		Encryption:     m.Encryption.ToEncryption(),
+		CorrelationID:  m.CorrelationID,
+		IdempotencyKey: m.IdempotencyKey,
 	}, nil
 }
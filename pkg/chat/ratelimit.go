@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// eventRateLimiter holds the per-user and per-channel budgets of an event type, stored under its bucket name.
+// A nil limiter means the scope is unlimited
+type eventRateLimiter struct {
+	bucket  string
+	user    *common.RateLimiter
+	channel *common.RateLimiter
+}
+
+func newEventRateLimiter(rc redis.UniversalClient, bucket string, limit config.EventRateLimitConfig, expiration time.Duration) *eventRateLimiter {
+	newLimiter := func(limit config.RateLimitConfig) *common.RateLimiter {
+		if limit.Rps <= 0 {
+			return nil
+		}
+		return common.NewRateLimiter(rc, limit.Rps, limit.Burst, expiration)
+	}
+	return &eventRateLimiter{
+		bucket:  bucket,
+		user:    newLimiter(limit.User),
+		channel: newLimiter(limit.Channel),
+	}
+}
+
+// MessageRateLimiter limits websocket frames of each event type with redis token buckets
+type MessageRateLimiter struct {
+	limiters        map[int]*eventRateLimiter
+	maxViolations   int
+	violationWindow time.Duration
+}
+
+func NewMessageRateLimiter(rc redis.UniversalClient, config *config.Config) *MessageRateLimiter {
+	expiration := time.Duration(config.Redis.ExpirationHour) * time.Hour
+	rateLimit := config.Chat.RateLimit
+	// pinning and unpinning share a budget
+	pin := newEventRateLimiter(rc, "pin", rateLimit.Pin, expiration)
+	return &MessageRateLimiter{
+		limiters: map[int]*eventRateLimiter{
+			EventText:        newEventRateLimiter(rc, strconv.Itoa(EventText), rateLimit.Text, expiration),
+			EventAction:      newEventRateLimiter(rc, strconv.Itoa(EventAction), rateLimit.Action, expiration),
+			EventSeen:        newEventRateLimiter(rc, strconv.Itoa(EventSeen), rateLimit.Seen, expiration),
+			EventFile:        newEventRateLimiter(rc, strconv.Itoa(EventFile), rateLimit.File, expiration),
+			EventEdit:        newEventRateLimiter(rc, strconv.Itoa(EventEdit), rateLimit.Edit, expiration),
+			EventDelete:      newEventRateLimiter(rc, strconv.Itoa(EventDelete), rateLimit.Delete, expiration),
+			EventReaction:    newEventRateLimiter(rc, strconv.Itoa(EventReaction), rateLimit.Reaction, expiration),
+			EventKeyExchange: newEventRateLimiter(rc, strconv.Itoa(EventKeyExchange), rateLimit.KeyExchange, expiration),
+			EventPin:         pin,
+			EventUnpin:       pin,
+		},
+		maxViolations:   rateLimit.MaxViolations,
+		violationWindow: time.Duration(rateLimit.ViolationWindowSec) * time.Second,
+	}
+}
+
+// Allow reports whether a frame of the event is within the budgets of both the user and the channel
+func (l *MessageRateLimiter) Allow(ctx context.Context, channelID, userID uint64, event int) (bool, error) {
+	limiter, ok := l.limiters[event]
+	if !ok {
+		return true, nil
+	}
+	if limiter.user != nil {
+		allow, err := limiter.user.Allow(ctx, common.Join("chat:user:", strconv.FormatUint(userID, 10), ":", limiter.bucket))
+		if err != nil || !allow {
+			return false, err
+		}
+	}
+	if limiter.channel != nil {
+		allow, err := limiter.channel.Allow(ctx, common.Join("chat:chan:", strconv.FormatUint(channelID, 10), ":", limiter.bucket))
+		if err != nil || !allow {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (l *MessageRateLimiter) newViolationTracker() *violationTracker {
+	return &violationTracker{
+		window: l.violationWindow,
+		max:    l.maxViolations,
+	}
+}
+
+// violationTracker counts the throttled frames of a session in a fixed time window
+type violationTracker struct {
+	mu          sync.Mutex
+	window      time.Duration
+	max         int
+	windowStart time.Time
+	count       int
+}
+
+// record adds a throttled frame and reports whether the session has exceeded the maximum violations in the window.
+// A non-positive maximum never disconnects
+func (t *violationTracker) record(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.windowStart) >= t.window {
+		t.windowStart = now
+		t.count = 0
+	}
+	t.count++
+	return t.max > 0 && t.count > t.max
+}
@@ -19,24 +19,58 @@ import (
 
 var (
 	MessagePubTopic = "rc.msg.pub"
+	// ChannelEventTopic carries channel lifecycle events for consumers outside the chat service
+	ChannelEventTopic = "rc.channel.event"
+)
+
+const (
+	selectMessagesStmt = "SELECT id, event, channel_id, user_id, payload, timestamp, edited_at, deleted, reply_to, expire_at, encryption_alg, encryption_nonce, encryption_kid FROM messages"
+
+	// messageTTLGraceSec keeps expiring messages in cassandra a bit longer than their retention,
+	// so that the message expirer can still read them when cleaning up; the TTL is only a backstop
+	messageTTLGraceSec = 300
 )
 
 type UserRepo interface {
 	AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error
 	GetUserByID(ctx context.Context, userID uint64) (*User, error)
 	GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	RemoveUserFromChannel(ctx context.Context, channelID, userID uint64) error
+	GetChannelMemberLimit(ctx context.Context, channelID uint64) (int, error)
+	SetChannelMemberLimit(ctx context.Context, channelID uint64, maxMembers int) error
 }
 
 type MessageRepo interface {
 	InsertMessage(ctx context.Context, msg *Message) error
-	MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error
+	GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error)
+	GetMessagesByIDs(ctx context.Context, channelID uint64, messageIDs []uint64) ([]*Message, error)
+	UpdateMessagePayload(ctx context.Context, channelID, messageID uint64, payload string, encryption *Encryption, editedAt int64) error
+	TombstoneMessage(ctx context.Context, channelID, messageID uint64) error
+	AddReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error
+	RemoveReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error
+	GetReactionCounts(ctx context.Context, channelID uint64, messageIDs []uint64) (map[uint64]map[string]int64, error)
+	InsertPin(ctx context.Context, pin *Pin) error
+	DeletePin(ctx context.Context, channelID, messageID uint64) error
+	GetPins(ctx context.Context, channelID uint64) ([]*Pin, error)
+	UpsertPublicKey(ctx context.Context, channelID uint64, key *PublicKey) error
+	GetPublicKeys(ctx context.Context, channelID uint64) ([]*PublicKey, error)
+	UpdateReadWatermark(ctx context.Context, channelID, userID, messageID uint64) (bool, error)
+	GetReadWatermarks(ctx context.Context, channelID uint64) (map[uint64]uint64, error)
+	CountUnreadMessages(ctx context.Context, channelID, userID, afterID uint64, limit int) (int64, error)
 	PublishMessage(ctx context.Context, msg *Message) error
 	ListMessages(ctx context.Context, channelID uint64, pageStateBase64 string) ([]*Message, string, error)
+	QueryMessages(ctx context.Context, channelID uint64, query *MessageQuery) ([]*Message, bool, error)
+	ExpireMessage(ctx context.Context, channelID, messageID uint64) error
+	DecrementMessageCount(ctx context.Context, channelID uint64) error
+	GetChannelRetention(ctx context.Context, channelID uint64) (int64, error)
+	SetChannelRetention(ctx context.Context, channelID uint64, retentionSec int64) error
+	StreamMessages(ctx context.Context, channelID uint64, fn func(*Message) error) error
 }
 
 type ChannelRepo interface {
-	CreateChannel(ctx context.Context, channelID uint64) (*Channel, error)
+	CreateChannel(ctx context.Context, channelID uint64, retentionSec int64, maxMembers int) (*Channel, error)
 	DeleteChannel(ctx context.Context, channelID uint64) error
+	PublishChannelEvent(ctx context.Context, event *ChannelEvent) error
 }
 
 type ForwardRepo interface {
@@ -97,15 +131,49 @@ func (repo *UserRepoImpl) GetChannelUserIDs(ctx context.Context, channelID uint6
 	return userIDs, nil
 }
 
+// RemoveUserFromChannel removes the member and the public key it has published to the channel
+func (repo *UserRepoImpl) RemoveUserFromChannel(ctx context.Context, channelID, userID uint64) error {
+	if err := repo.s.Query("DELETE FROM channels WHERE id = ? AND user_id = ?", channelID, userID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM channel_keys WHERE channel_id = ? AND user_id = ?", channelID, userID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetChannelMemberLimit returns the maximum number of members of the channel, where 0 means not set
+func (repo *UserRepoImpl) GetChannelMemberLimit(ctx context.Context, channelID uint64) (int, error) {
+	var maxMembers int
+	if err := repo.s.Query("SELECT max_members FROM channels WHERE id = ? LIMIT 1", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&maxMembers); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return maxMembers, nil
+}
+func (repo *UserRepoImpl) SetChannelMemberLimit(ctx context.Context, channelID uint64, maxMembers int) error {
+	if err := repo.s.Query("UPDATE channels SET max_members = ? WHERE id = ?", maxMembers, channelID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
 type MessageRepoImpl struct {
-	s           *gocql.Session
-	p           message.Publisher
-	maxMessages int64
-	pagination  int
+	s                *gocql.Session
+	p                message.Publisher
+	maxMessages      int64
+	pagination       int
+	defaultRetention int64
 }
 
 func NewMessageRepoImpl(config *config.Config, s *gocql.Session, p message.Publisher) *MessageRepoImpl {
-	return &MessageRepoImpl{s, p, config.Chat.Message.MaxNum, config.Chat.Message.PaginationNum}
+	return &MessageRepoImpl{s, p, config.Chat.Message.MaxNum, config.Chat.Message.PaginationNum, config.Chat.Message.RetentionSec}
 }
 
 func (repo *MessageRepoImpl) InsertMessage(ctx context.Context, msg *Message) error {
@@ -122,25 +190,283 @@ func (repo *MessageRepoImpl) InsertMessage(ctx context.Context, msg *Message) er
 	if messageNum >= repo.maxMessages {
 		return ErrExceedMessageNumLimits
 	}
-	if err := repo.s.Query("INSERT INTO messages (id, event, channel_id, user_id, payload, seen, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	var ttl int64
+	if msg.ExpireAt > 0 {
+		ttl = (msg.ExpireAt-msg.Time)/1000 + messageTTLGraceSec
+	}
+	alg, nonce, kid := encryptionColumns(msg.Encryption)
+	if err := repo.s.Query("INSERT INTO messages (id, event, channel_id, user_id, payload, timestamp, reply_to, expire_at, encryption_alg, encryption_nonce, encryption_kid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?",
 		msg.MessageID,
 		msg.Event,
 		msg.ChannelID,
 		msg.UserID,
 		msg.Payload,
-		false,
-		msg.Time).WithContext(ctx).Exec(); err != nil {
+		msg.Time,
+		msg.ReplyTo,
+		msg.ExpireAt,
+		alg,
+		nonce,
+		kid,
+		ttl).WithContext(ctx).Exec(); err != nil {
 		return err
 	}
 	return repo.s.Query("UPDATE chanmsg_counters SET msgnum = msgnum + 1 WHERE channel_id = ?", msg.ChannelID).WithContext(ctx).Exec()
 }
-func (repo *MessageRepoImpl) MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error {
-	if err := repo.s.Query("UPDATE messages SET seen = ? WHERE channel_id = ? AND id = ?", true, channelID, messageID).
+func (repo *MessageRepoImpl) GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	message, err := scanMessage(repo.s.Query(selectMessagesStmt+" WHERE channel_id = ? AND id = ? LIMIT 1", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Scan)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return message, nil
+}
+func (repo *MessageRepoImpl) GetMessagesByIDs(ctx context.Context, channelID uint64, messageIDs []uint64) ([]*Message, error) {
+	var messages []*Message
+	if len(messageIDs) == 0 {
+		return messages, nil
+	}
+	scanner := repo.s.Query(selectMessagesStmt+" WHERE channel_id = ? AND id IN ?", channelID, messageIDs).
+		WithContext(ctx).Idempotent(true).Iter().Scanner()
+	for scanner.Next() {
+		message, err := scanMessage(scanner.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+func (repo *MessageRepoImpl) UpdateMessagePayload(ctx context.Context, channelID, messageID uint64, payload string, encryption *Encryption, editedAt int64) error {
+	ttl, err := repo.getMessageTTL(ctx, channelID, messageID)
+	if err != nil {
+		return err
+	}
+	alg, nonce, kid := encryptionColumns(encryption)
+	if err := repo.s.Query("UPDATE messages USING TTL ? SET payload = ?, encryption_alg = ?, encryption_nonce = ?, encryption_kid = ?, edited_at = ? WHERE channel_id = ? AND id = ?",
+		ttl, payload, alg, nonce, kid, editedAt, channelID, messageID).
 		WithContext(ctx).Idempotent(true).Exec(); err != nil {
 		return err
 	}
 	return nil
 }
+
+// TombstoneMessage clears the payload of a message but keeps its row,
+// so that message counters and pagination remain consistent
+func (repo *MessageRepoImpl) TombstoneMessage(ctx context.Context, channelID, messageID uint64) error {
+	ttl, err := repo.getMessageTTL(ctx, channelID, messageID)
+	if err != nil {
+		return err
+	}
+	if err := repo.s.Query("UPDATE messages USING TTL ? SET payload = ?, deleted = ? WHERE channel_id = ? AND id = ?", ttl, "", true, channelID, messageID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ExpireMessage removes a message whose retention is over along with its reactions and pin.
+// It is idempotent, unlike DecrementMessageCount, which must run once per expired message
+func (repo *MessageRepoImpl) ExpireMessage(ctx context.Context, channelID, messageID uint64) error {
+	if err := repo.s.Query("DELETE FROM messages WHERE channel_id = ? AND id = ?", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM reactions WHERE channel_id = ? AND message_id = ?", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return repo.DeletePin(ctx, channelID, messageID)
+}
+
+// DecrementMessageCount takes an expired message off the message counter so that the cap only counts live messages
+func (repo *MessageRepoImpl) DecrementMessageCount(ctx context.Context, channelID uint64) error {
+	return repo.s.Query("UPDATE chanmsg_counters SET msgnum = msgnum - 1 WHERE channel_id = ?", channelID).WithContext(ctx).Exec()
+}
+
+// GetChannelRetention returns the retention of messages in the channel in seconds, where 0 means forever.
+// Channels without their own retention use the configured default
+func (repo *MessageRepoImpl) GetChannelRetention(ctx context.Context, channelID uint64) (int64, error) {
+	var retentionSec int64
+	if err := repo.s.Query("SELECT retention_sec FROM channels WHERE id = ? LIMIT 1", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&retentionSec); err != nil {
+		if err == gocql.ErrNotFound {
+			return repo.defaultRetention, nil
+		}
+		return 0, err
+	}
+	if retentionSec == 0 {
+		return repo.defaultRetention, nil
+	}
+	return retentionSec, nil
+}
+func (repo *MessageRepoImpl) SetChannelRetention(ctx context.Context, channelID uint64, retentionSec int64) error {
+	if err := repo.s.Query("UPDATE channels SET retention_sec = ? WHERE id = ?", retentionSec, channelID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getMessageTTL returns the remaining TTL of a message, so that updates expire together with the inserted row
+func (repo *MessageRepoImpl) getMessageTTL(ctx context.Context, channelID, messageID uint64) (int64, error) {
+	var ttl int64
+	if err := repo.s.Query("SELECT TTL(event) FROM messages WHERE channel_id = ? AND id = ? LIMIT 1", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Scan(&ttl); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, ErrMessageNotFound
+		}
+		return 0, err
+	}
+	return ttl, nil
+}
+func (repo *MessageRepoImpl) AddReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error {
+	if err := repo.s.Query("INSERT INTO reactions (channel_id, message_id, user_id, emoji) VALUES (?, ?, ?, ?)",
+		channelID, messageID, userID, emoji).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *MessageRepoImpl) RemoveReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error {
+	if err := repo.s.Query("DELETE FROM reactions WHERE channel_id = ? AND message_id = ? AND user_id = ? AND emoji = ?",
+		channelID, messageID, userID, emoji).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *MessageRepoImpl) GetReactionCounts(ctx context.Context, channelID uint64, messageIDs []uint64) (map[uint64]map[string]int64, error) {
+	counts := make(map[uint64]map[string]int64)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+	iter := repo.s.Query("SELECT message_id, emoji FROM reactions WHERE channel_id = ? AND message_id IN ?", channelID, messageIDs).
+		WithContext(ctx).Idempotent(true).Iter()
+	var messageID uint64
+	var emoji string
+	for iter.Scan(&messageID, &emoji) {
+		if _, ok := counts[messageID]; !ok {
+			counts[messageID] = make(map[string]int64)
+		}
+		counts[messageID][emoji]++
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+func (repo *MessageRepoImpl) InsertPin(ctx context.Context, pin *Pin) error {
+	if err := repo.s.Query("INSERT INTO pinned_messages (channel_id, message_id, pinned_by, pinned_at) VALUES (?, ?, ?, ?)",
+		pin.ChannelID, pin.MessageID, pin.PinnedBy, pin.PinnedAt).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *MessageRepoImpl) DeletePin(ctx context.Context, channelID, messageID uint64) error {
+	if err := repo.s.Query("DELETE FROM pinned_messages WHERE channel_id = ? AND message_id = ?", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *MessageRepoImpl) GetPins(ctx context.Context, channelID uint64) ([]*Pin, error) {
+	iter := repo.s.Query("SELECT message_id, pinned_by, pinned_at FROM pinned_messages WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Iter()
+	var pins []*Pin
+	var messageID, pinnedBy uint64
+	var pinnedAt int64
+	for iter.Scan(&messageID, &pinnedBy, &pinnedAt) {
+		pins = append(pins, &Pin{
+			ChannelID: channelID,
+			MessageID: messageID,
+			PinnedBy:  pinnedBy,
+			PinnedAt:  pinnedAt,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+func (repo *MessageRepoImpl) UpsertPublicKey(ctx context.Context, channelID uint64, key *PublicKey) error {
+	if err := repo.s.Query("INSERT INTO channel_keys (channel_id, user_id, algorithm, public_key, updated_at) VALUES (?, ?, ?, ?, ?)",
+		channelID, key.UserID, key.Algorithm, key.Key, key.UpdatedAt).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *MessageRepoImpl) GetPublicKeys(ctx context.Context, channelID uint64) ([]*PublicKey, error) {
+	iter := repo.s.Query("SELECT user_id, algorithm, public_key, updated_at FROM channel_keys WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Iter()
+	var keys []*PublicKey
+	var userID uint64
+	var algorithm, publicKey string
+	var updatedAt int64
+	for iter.Scan(&userID, &algorithm, &publicKey, &updatedAt) {
+		keys = append(keys, &PublicKey{
+			UserID:    userID,
+			Algorithm: algorithm,
+			Key:       publicKey,
+			UpdatedAt: updatedAt,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// UpdateReadWatermark moves the last message seen by the user forward.
+// It reports false if the watermark is already at or beyond the message
+func (repo *MessageRepoImpl) UpdateReadWatermark(ctx context.Context, channelID, userID, messageID uint64) (bool, error) {
+	applied, err := repo.s.Query("INSERT INTO read_watermarks (channel_id, user_id, message_id) VALUES (?, ?, ?) IF NOT EXISTS",
+		channelID, userID, messageID).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return false, err
+	}
+	if applied {
+		return true, nil
+	}
+	return repo.s.Query("UPDATE read_watermarks SET message_id = ? WHERE channel_id = ? AND user_id = ? IF message_id < ?",
+		messageID, channelID, userID, messageID).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+}
+func (repo *MessageRepoImpl) GetReadWatermarks(ctx context.Context, channelID uint64) (map[uint64]uint64, error) {
+	iter := repo.s.Query("SELECT user_id, message_id FROM read_watermarks WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Iter()
+	watermarks := make(map[uint64]uint64)
+	var userID, messageID uint64
+	for iter.Scan(&userID, &messageID) {
+		watermarks[userID] = messageID
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return watermarks, nil
+}
+
+// CountUnreadMessages counts text and file messages sent by others after the given message,
+// and stops scanning the channel once it has counted limit messages
+func (repo *MessageRepoImpl) CountUnreadMessages(ctx context.Context, channelID, userID, afterID uint64, limit int) (int64, error) {
+	iter := repo.s.Query("SELECT user_id, event, deleted FROM messages WHERE channel_id = ? AND id > ?", channelID, afterID).
+		WithContext(ctx).Idempotent(true).PageSize(limit).Iter()
+	var count int64
+	var senderID uint64
+	var event int
+	var deleted bool
+	for count < int64(limit) && iter.Scan(&senderID, &event, &deleted) {
+		if senderID != userID && (event == EventText || event == EventFile) && !deleted {
+			count++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
 func (repo *MessageRepoImpl) PublishMessage(ctx context.Context, msg *Message) error {
 	return repo.p.Publish(MessagePubTopic, message.NewMessage(
 		watermill.NewUUID(),
@@ -153,24 +479,17 @@ func (repo *MessageRepoImpl) ListMessages(ctx context.Context, channelID uint64,
 	if err != nil {
 		return nil, "", err
 	}
-	iter := repo.s.Query(`SELECT id, event, channel_id, user_id, payload, seen, timestamp FROM messages WHERE channel_id = ?`, channelID).
+	iter := repo.s.Query(selectMessagesStmt+" WHERE channel_id = ?", channelID).
 		WithContext(ctx).Idempotent(true).PageSize(repo.pagination).PageState(pageState).Iter()
 	nextPageStateBase64 := b64.URLEncoding.EncodeToString(iter.PageState())
 	scanner := iter.Scanner()
 
 	for scanner.Next() {
-		var message Message
-		if err = scanner.Scan(
-			&message.MessageID,
-			&message.Event,
-			&message.ChannelID,
-			&message.UserID,
-			&message.Payload,
-			&message.Seen,
-			&message.Time); err != nil {
+		message, err := scanMessage(scanner.Scan)
+		if err != nil {
 			return nil, "", err
 		}
-		messages = append(messages, &message)
+		messages = append(messages, message)
 	}
 	err = scanner.Err()
 	if err != nil {
@@ -179,17 +498,116 @@ func (repo *MessageRepoImpl) ListMessages(ctx context.Context, channelID uint64,
 	return messages, nextPageStateBase64, nil
 }
 
+// QueryMessages lists messages within the ID range of the query, which is capped by the pagination number.
+// It also reports whether there are more messages beyond the returned ones
+func (repo *MessageRepoImpl) QueryMessages(ctx context.Context, channelID uint64, query *MessageQuery) ([]*Message, bool, error) {
+	var messages []*Message
+	limit := query.Limit
+	if limit <= 0 || limit > repo.pagination {
+		limit = repo.pagination
+	}
+	stmt := selectMessagesStmt + " WHERE channel_id = ?"
+	values := []interface{}{channelID}
+	if query.BeforeID != 0 {
+		stmt += " AND id < ?"
+		values = append(values, query.BeforeID)
+	}
+	if query.AfterID != 0 {
+		stmt += " AND id > ?"
+		values = append(values, query.AfterID)
+	}
+	if query.Asc {
+		stmt += " ORDER BY id ASC"
+	} else {
+		stmt += " ORDER BY id DESC"
+	}
+	stmt += " LIMIT ?"
+	values = append(values, limit+1)
+
+	scanner := repo.s.Query(stmt, values...).WithContext(ctx).Idempotent(true).Iter().Scanner()
+	for scanner.Next() {
+		message, err := scanMessage(scanner.Scan)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(messages) > limit {
+		return messages[:limit], true, nil
+	}
+	return messages, false, nil
+}
+
+// StreamMessages calls fn on every message of the channel from the oldest one. Messages are fetched page by page
+// so the whole history is never held in memory
+func (repo *MessageRepoImpl) StreamMessages(ctx context.Context, channelID uint64, fn func(*Message) error) error {
+	iter := repo.s.Query(selectMessagesStmt+" WHERE channel_id = ? ORDER BY id ASC", channelID).
+		WithContext(ctx).Idempotent(true).PageSize(repo.pagination).Iter()
+	scanner := iter.Scanner()
+	for scanner.Next() {
+		message, err := scanMessage(scanner.Scan)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if err := fn(message); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func scanMessage(scan func(dest ...interface{}) error) (*Message, error) {
+	var message Message
+	var encryption Encryption
+	if err := scan(
+		&message.MessageID,
+		&message.Event,
+		&message.ChannelID,
+		&message.UserID,
+		&message.Payload,
+		&message.Time,
+		&message.EditedAt,
+		&message.Deleted,
+		&message.ReplyTo,
+		&message.ExpireAt,
+		&encryption.Algorithm,
+		&encryption.Nonce,
+		&encryption.KeyID); err != nil {
+		return nil, err
+	}
+	if message.Deleted {
+		message.Payload = ""
+	} else if encryption.Algorithm != "" {
+		message.Encryption = &encryption
+	}
+	return &message, nil
+}
+
+// encryptionColumns returns empty columns for a plaintext payload
+func encryptionColumns(encryption *Encryption) (string, string, string) {
+	if encryption == nil {
+		return "", "", ""
+	}
+	return encryption.Algorithm, encryption.Nonce, encryption.KeyID
+}
+
 type ChannelRepoImpl struct {
 	s *gocql.Session
+	p message.Publisher
 }
 
-func NewChannelRepoImpl(s *gocql.Session) *ChannelRepoImpl {
-	return &ChannelRepoImpl{s}
+func NewChannelRepoImpl(s *gocql.Session, p message.Publisher) *ChannelRepoImpl {
+	return &ChannelRepoImpl{s, p}
 }
 
-func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, channelID uint64) (*Channel, error) {
-	if err := repo.s.Query("INSERT INTO channels (id, user_id) VALUES (?, ?)",
-		channelID, 0).WithContext(ctx).Exec(); err != nil {
+func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, channelID uint64, retentionSec int64, maxMembers int) (*Channel, error) {
+	if err := repo.s.Query("INSERT INTO channels (id, user_id, retention_sec, max_members) VALUES (?, ?, ?, ?)",
+		channelID, 0, retentionSec, maxMembers).WithContext(ctx).Exec(); err != nil {
 		return nil, err
 	}
 	accessToken, err := common.NewJWT(channelID)
@@ -201,13 +619,37 @@ func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, channelID uint64
 		AccessToken: accessToken,
 	}, nil
 }
+
+// DeleteChannel removes the channel, its pinned messages, reactions and read watermarks, and the public keys of its members
 func (repo *ChannelRepoImpl) DeleteChannel(ctx context.Context, channelID uint64) error {
 	if err := repo.s.Query("DELETE FROM channels WHERE id = ?", channelID).
 		WithContext(ctx).Exec(); err != nil {
 		return err
 	}
+	if err := repo.s.Query("DELETE FROM pinned_messages WHERE channel_id = ?", channelID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM channel_keys WHERE channel_id = ?", channelID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM reactions WHERE channel_id = ?", channelID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM read_watermarks WHERE channel_id = ?", channelID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
 	return nil
 }
+func (repo *ChannelRepoImpl) PublishChannelEvent(ctx context.Context, event *ChannelEvent) error {
+	return repo.p.Publish(ChannelEventTopic, message.NewMessage(
+		watermill.NewUUID(),
+		event.Encode(),
+	))
+}
 
 type ForwardRepoImpl struct {
 	registerChannelSession endpoint.Endpoint
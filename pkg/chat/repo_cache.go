@@ -2,7 +2,10 @@ package chat
 
 import (
 	"context"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"github.com/minghsu0107/go-random-chat/pkg/infra"
@@ -11,28 +14,76 @@ import (
 var (
 	channelUsersPrefix = "rc:chanusers"
 	onlineUsersPrefix  = "rc:onlineusers"
+
+	channelRetentionPrefix = "rc:chanretention"
+	msgExpiryKey           = "rc:msgexpiry"
+	msgExpiredPrefix       = "rc:msgexpired"
+	idempotencyPrefix      = "rc:idempotency"
+
+	tokenRefreshPrefix   = "rc:tokenrefresh"
+	tokenFamilyPrefix    = "rc:tokenfamily"
+	channelRevokedPrefix = "rc:chanrevoked"
+
+	EphemeralPubTopic = "rc.ephemeral.pub"
 )
 
+// msgExpiredTTL is how long the decrement of an expired message is remembered, which outlasts the retries of its expiry
+const msgExpiredTTL = 24 * time.Hour
+
 type UserRepoCache interface {
 	AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error
+	AddUserToChannelWithLimit(ctx context.Context, channelID uint64, userID uint64, maxMembers int) error
 	GetUserByID(ctx context.Context, userID uint64) (*User, error)
 	IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error)
 	GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
 	AddOnlineUser(ctx context.Context, channelID uint64, userID uint64) error
 	DeleteOnlineUser(ctx context.Context, channelID, userID uint64) error
 	GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	RemoveUserFromChannel(ctx context.Context, channelID, userID uint64) error
+	GetChannelMemberLimit(ctx context.Context, channelID uint64) (int, error)
+	SetChannelMemberLimit(ctx context.Context, channelID uint64, maxMembers int) error
 }
 
 type MessageRepoCache interface {
 	InsertMessage(ctx context.Context, msg *Message) error
-	MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error
+	GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error)
+	GetMessagesByIDs(ctx context.Context, channelID uint64, messageIDs []uint64) ([]*Message, error)
+	UpdateMessagePayload(ctx context.Context, channelID, messageID uint64, payload string, encryption *Encryption, editedAt int64) error
+	TombstoneMessage(ctx context.Context, channelID, messageID uint64) error
+	AddReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error
+	RemoveReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error
+	GetReactionCounts(ctx context.Context, channelID uint64, messageIDs []uint64) (map[uint64]map[string]int64, error)
+	InsertPin(ctx context.Context, pin *Pin) error
+	DeletePin(ctx context.Context, channelID, messageID uint64) error
+	GetPins(ctx context.Context, channelID uint64) ([]*Pin, error)
+	UpsertPublicKey(ctx context.Context, channelID uint64, key *PublicKey) error
+	GetPublicKeys(ctx context.Context, channelID uint64) ([]*PublicKey, error)
+	UpdateReadWatermark(ctx context.Context, channelID, userID, messageID uint64) (bool, error)
+	GetReadWatermarks(ctx context.Context, channelID uint64) (map[uint64]uint64, error)
+	CountUnreadMessages(ctx context.Context, channelID, userID, afterID uint64, limit int) (int64, error)
 	PublishMessage(ctx context.Context, msg *Message) error
+	PublishEphemeralMessage(ctx context.Context, msg *Message) error
 	ListMessages(ctx context.Context, channelID uint64, pageStateStr string) ([]*Message, string, error)
+	QueryMessages(ctx context.Context, channelID uint64, query *MessageQuery) ([]*Message, bool, error)
+	LeaseExpiredMessages(ctx context.Context, before int64, leaseUntil int64, count int64) ([]*MessageRef, error)
+	AckExpiredMessage(ctx context.Context, ref *MessageRef) error
+	ExpireMessage(ctx context.Context, channelID, messageID uint64) error
+	GetChannelRetention(ctx context.Context, channelID uint64) (int64, error)
+	SetChannelRetention(ctx context.Context, channelID uint64, retentionSec int64) error
+	StreamMessages(ctx context.Context, channelID uint64, fn func(*Message) error) error
+	ReserveIdempotencyKey(ctx context.Context, channelID, userID uint64, key string, messageID uint64, ttl time.Duration) (uint64, bool, error)
+	ReleaseIdempotencyKey(ctx context.Context, channelID, userID uint64, key string) error
 }
 
 type ChannelRepoCache interface {
-	CreateChannel(ctx context.Context, channelID uint64) (*Channel, error)
+	CreateChannel(ctx context.Context, channelID uint64, retentionSec int64, maxMembers int) (*Channel, error)
 	DeleteChannel(ctx context.Context, channelID uint64) error
+	MarkTokenRefreshed(ctx context.Context, tokenID string, ttl time.Duration) (bool, error)
+	RevokeTokenFamily(ctx context.Context, family string, ttl time.Duration) error
+	IsTokenFamilyRevoked(ctx context.Context, family string) (bool, error)
+	RevokeChannel(ctx context.Context, channelID uint64, ttl time.Duration) error
+	IsChannelRevoked(ctx context.Context, channelID uint64) (bool, error)
+	PublishChannelEvent(ctx context.Context, event *ChannelEvent) error
 }
 
 type UserRepoCacheImpl struct {
@@ -45,11 +96,54 @@ func NewUserRepoCacheImpl(r infra.RedisCache, userRepo UserRepo) *UserRepoCacheI
 }
 func (cache *UserRepoCacheImpl) AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error {
 	if err := cache.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
-		return nil
+		return err
 	}
 	key := constructKey(channelUsersPrefix, channelID)
 	return cache.r.HSet(ctx, key, strconv.FormatUint(userID, 10), 1)
 }
+
+// AddUserToChannelWithLimit adds the user to the channel unless the channel already has maxMembers members.
+// The member is reserved in the cached member set with a single redis script, so concurrent joins cannot
+// exceed the limit, and the reservation is undone if it cannot be persisted
+func (cache *UserRepoCacheImpl) AddUserToChannelWithLimit(ctx context.Context, channelID uint64, userID uint64, maxMembers int) error {
+	key := constructKey(channelUsersPrefix, channelID)
+	field := strconv.FormatUint(userID, 10)
+	for attempt := 0; attempt < 2; attempt++ {
+		// the placeholder user inserted on channel creation is not a member
+		var dummy int
+		keyExists, hasPlaceholder, err := cache.r.HGetIfKeyExists(ctx, key, "0", &dummy)
+		if err != nil {
+			return err
+		}
+		if !keyExists {
+			// load the member set into the cache and try again
+			if _, err := cache.GetChannelUserIDs(ctx, channelID); err != nil {
+				return err
+			}
+			continue
+		}
+		limit := int64(maxMembers)
+		if hasPlaceholder {
+			limit++
+		}
+		keyExists, set, err := cache.r.HSetNXIfKeyExistsWithLimit(ctx, key, field, 1, limit)
+		if err != nil {
+			return err
+		}
+		if !keyExists {
+			continue
+		}
+		if !set {
+			return ErrChannelFull
+		}
+		if err := cache.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
+			_ = cache.r.HDel(ctx, key, field)
+			return err
+		}
+		return nil
+	}
+	return ErrChannelOrUserNotFound
+}
 func (cache *UserRepoCacheImpl) GetUserByID(ctx context.Context, userID uint64) (*User, error) {
 	return cache.userRepo.GetUserByID(ctx, userID)
 }
@@ -141,28 +235,195 @@ func (cache *UserRepoCacheImpl) GetOnlineUserIDs(ctx context.Context, channelID
 	}
 	return userIDs, nil
 }
+func (cache *UserRepoCacheImpl) RemoveUserFromChannel(ctx context.Context, channelID, userID uint64) error {
+	if err := cache.userRepo.RemoveUserFromChannel(ctx, channelID, userID); err != nil {
+		return err
+	}
+	key := constructKey(channelUsersPrefix, channelID)
+	return cache.r.HDel(ctx, key, strconv.FormatUint(userID, 10))
+}
+func (cache *UserRepoCacheImpl) GetChannelMemberLimit(ctx context.Context, channelID uint64) (int, error) {
+	return cache.userRepo.GetChannelMemberLimit(ctx, channelID)
+}
+func (cache *UserRepoCacheImpl) SetChannelMemberLimit(ctx context.Context, channelID uint64, maxMembers int) error {
+	return cache.userRepo.SetChannelMemberLimit(ctx, channelID, maxMembers)
+}
 
 type MessageRepoCacheImpl struct {
+	r           infra.RedisCache
 	messageRepo MessageRepo
 }
 
-func NewMessageRepoCacheImpl(messageRepo MessageRepo) *MessageRepoCacheImpl {
-	return &MessageRepoCacheImpl{messageRepo}
+func NewMessageRepoCacheImpl(r infra.RedisCache, messageRepo MessageRepo) *MessageRepoCacheImpl {
+	return &MessageRepoCacheImpl{r, messageRepo}
 }
 
+// InsertMessage also schedules the expiry of the message if the channel has a retention
 func (cache *MessageRepoCacheImpl) InsertMessage(ctx context.Context, msg *Message) error {
-	return cache.messageRepo.InsertMessage(ctx, msg)
+	if err := cache.messageRepo.InsertMessage(ctx, msg); err != nil {
+		return err
+	}
+	if msg.ExpireAt == 0 {
+		return nil
+	}
+	return cache.r.ZAddOne(ctx, msgExpiryKey, float64(msg.ExpireAt), constructMessageRef(msg.ChannelID, msg.MessageID))
+}
+func (cache *MessageRepoCacheImpl) GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	return cache.messageRepo.GetMessage(ctx, channelID, messageID)
+}
+func (cache *MessageRepoCacheImpl) GetMessagesByIDs(ctx context.Context, channelID uint64, messageIDs []uint64) ([]*Message, error) {
+	return cache.messageRepo.GetMessagesByIDs(ctx, channelID, messageIDs)
+}
+func (cache *MessageRepoCacheImpl) UpdateMessagePayload(ctx context.Context, channelID, messageID uint64, payload string, encryption *Encryption, editedAt int64) error {
+	return cache.messageRepo.UpdateMessagePayload(ctx, channelID, messageID, payload, encryption, editedAt)
+}
+func (cache *MessageRepoCacheImpl) TombstoneMessage(ctx context.Context, channelID, messageID uint64) error {
+	return cache.messageRepo.TombstoneMessage(ctx, channelID, messageID)
+}
+func (cache *MessageRepoCacheImpl) AddReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error {
+	return cache.messageRepo.AddReaction(ctx, channelID, messageID, userID, emoji)
+}
+func (cache *MessageRepoCacheImpl) RemoveReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string) error {
+	return cache.messageRepo.RemoveReaction(ctx, channelID, messageID, userID, emoji)
+}
+func (cache *MessageRepoCacheImpl) GetReactionCounts(ctx context.Context, channelID uint64, messageIDs []uint64) (map[uint64]map[string]int64, error) {
+	return cache.messageRepo.GetReactionCounts(ctx, channelID, messageIDs)
+}
+func (cache *MessageRepoCacheImpl) InsertPin(ctx context.Context, pin *Pin) error {
+	return cache.messageRepo.InsertPin(ctx, pin)
+}
+func (cache *MessageRepoCacheImpl) DeletePin(ctx context.Context, channelID, messageID uint64) error {
+	return cache.messageRepo.DeletePin(ctx, channelID, messageID)
+}
+func (cache *MessageRepoCacheImpl) GetPins(ctx context.Context, channelID uint64) ([]*Pin, error) {
+	return cache.messageRepo.GetPins(ctx, channelID)
+}
+func (cache *MessageRepoCacheImpl) UpsertPublicKey(ctx context.Context, channelID uint64, key *PublicKey) error {
+	return cache.messageRepo.UpsertPublicKey(ctx, channelID, key)
+}
+func (cache *MessageRepoCacheImpl) GetPublicKeys(ctx context.Context, channelID uint64) ([]*PublicKey, error) {
+	return cache.messageRepo.GetPublicKeys(ctx, channelID)
 }
-func (cache *MessageRepoCacheImpl) MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error {
-	return cache.messageRepo.MarkMessageSeen(ctx, channelID, messageID)
+func (cache *MessageRepoCacheImpl) UpdateReadWatermark(ctx context.Context, channelID, userID, messageID uint64) (bool, error) {
+	return cache.messageRepo.UpdateReadWatermark(ctx, channelID, userID, messageID)
+}
+func (cache *MessageRepoCacheImpl) GetReadWatermarks(ctx context.Context, channelID uint64) (map[uint64]uint64, error) {
+	return cache.messageRepo.GetReadWatermarks(ctx, channelID)
+}
+func (cache *MessageRepoCacheImpl) CountUnreadMessages(ctx context.Context, channelID, userID, afterID uint64, limit int) (int64, error) {
+	return cache.messageRepo.CountUnreadMessages(ctx, channelID, userID, afterID, limit)
 }
 func (cache *MessageRepoCacheImpl) PublishMessage(ctx context.Context, msg *Message) error {
 	return cache.messageRepo.PublishMessage(ctx, msg)
 }
+
+// PublishEphemeralMessage publishes the message to all chat nodes over redis pub/sub, bypassing kafka
+func (cache *MessageRepoCacheImpl) PublishEphemeralMessage(ctx context.Context, msg *Message) error {
+	return cache.r.Publish(ctx, EphemeralPubTopic, msg.Encode())
+}
 func (cache *MessageRepoCacheImpl) ListMessages(ctx context.Context, channelID uint64, pageStateStr string) ([]*Message, string, error) {
 	return cache.messageRepo.ListMessages(ctx, channelID, pageStateStr)
 }
 
+func (cache *MessageRepoCacheImpl) QueryMessages(ctx context.Context, channelID uint64, query *MessageQuery) ([]*Message, bool, error) {
+	return cache.messageRepo.QueryMessages(ctx, channelID, query)
+}
+
+// LeaseExpiredMessages hands out messages expiring before the given time until the lease ends.
+// Each message is leased by exactly one chat node at a time, and it stays on the expiry schedule
+// to be leased again unless it is acked, so that a failed or crashed node loses no expiry
+func (cache *MessageRepoCacheImpl) LeaseExpiredMessages(ctx context.Context, before int64, leaseUntil int64, count int64) ([]*MessageRef, error) {
+	members, err := cache.r.ZLeaseByScore(ctx, msgExpiryKey, float64(before), float64(leaseUntil), count)
+	if err != nil {
+		return nil, err
+	}
+	var refs []*MessageRef
+	for _, member := range members {
+		ref, err := parseMessageRef(member)
+		if err != nil {
+			// a malformed ref can never be expired, so it is dropped instead of holding up the schedule
+			if err := cache.r.ZRemOne(ctx, msgExpiryKey, member); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// AckExpiredMessage takes an expired message off the expiry schedule
+func (cache *MessageRepoCacheImpl) AckExpiredMessage(ctx context.Context, ref *MessageRef) error {
+	return cache.r.ZRemOne(ctx, msgExpiryKey, constructMessageRef(ref.ChannelID, ref.MessageID))
+}
+
+// ExpireMessage removes an expired message and decrements the message counter of its channel.
+// An expiry is retried until it is acked, so the decrement is recorded in redis
+// to be made only once however many times the message is expired
+func (cache *MessageRepoCacheImpl) ExpireMessage(ctx context.Context, channelID, messageID uint64) error {
+	if err := cache.messageRepo.ExpireMessage(ctx, channelID, messageID); err != nil {
+		return err
+	}
+	key := common.Join(msgExpiredPrefix, ":", constructMessageRef(channelID, messageID))
+	first, err := cache.r.SetNX(ctx, key, 1, msgExpiredTTL)
+	if err != nil || !first {
+		return err
+	}
+	if err := cache.messageRepo.DecrementMessageCount(ctx, channelID); err != nil {
+		if err := cache.r.Delete(ctx, key); err != nil {
+			return err
+		}
+		return err
+	}
+	return nil
+}
+func (cache *MessageRepoCacheImpl) GetChannelRetention(ctx context.Context, channelID uint64) (int64, error) {
+	key := constructKey(channelRetentionPrefix, channelID)
+	var retentionSec int64
+	exist, err := cache.r.Get(ctx, key, &retentionSec)
+	if err != nil {
+		return 0, err
+	}
+	if exist {
+		return retentionSec, nil
+	}
+	retentionSec, err = cache.messageRepo.GetChannelRetention(ctx, channelID)
+	if err != nil {
+		return 0, err
+	}
+	if err := cache.r.Set(ctx, key, retentionSec); err != nil {
+		return 0, err
+	}
+	return retentionSec, nil
+}
+func (cache *MessageRepoCacheImpl) SetChannelRetention(ctx context.Context, channelID uint64, retentionSec int64) error {
+	if err := cache.messageRepo.SetChannelRetention(ctx, channelID, retentionSec); err != nil {
+		return err
+	}
+	return cache.r.Delete(ctx, constructKey(channelRetentionPrefix, channelID))
+}
+func (cache *MessageRepoCacheImpl) StreamMessages(ctx context.Context, channelID uint64, fn func(*Message) error) error {
+	return cache.messageRepo.StreamMessages(ctx, channelID, fn)
+}
+
+// ReserveIdempotencyKey binds the idempotency key of the user to the message ID if the key is unused.
+// Otherwise it reports false with the message ID bound to the key
+func (cache *MessageRepoCacheImpl) ReserveIdempotencyKey(ctx context.Context, channelID, userID uint64, key string, messageID uint64, ttl time.Duration) (uint64, bool, error) {
+	redisKey := constructIdempotencyKey(channelID, userID, key)
+	reserved, err := cache.r.SetNX(ctx, redisKey, messageID, ttl)
+	if err != nil || reserved {
+		return messageID, reserved, err
+	}
+	var storedID uint64
+	if _, err := cache.r.Get(ctx, redisKey, &storedID); err != nil {
+		return 0, false, err
+	}
+	return storedID, false, nil
+}
+func (cache *MessageRepoCacheImpl) ReleaseIdempotencyKey(ctx context.Context, channelID, userID uint64, key string) error {
+	return cache.r.Delete(ctx, constructIdempotencyKey(channelID, userID, key))
+}
+
 type ChannelRepoCacheImpl struct {
 	r           infra.RedisCache
 	channelRepo ChannelRepo
@@ -172,8 +433,8 @@ func NewChannelRepoCacheImpl(r infra.RedisCache, channelRepo ChannelRepo) *Chann
 	return &ChannelRepoCacheImpl{r, channelRepo}
 }
 
-func (cache *ChannelRepoCacheImpl) CreateChannel(ctx context.Context, channelID uint64) (*Channel, error) {
-	return cache.channelRepo.CreateChannel(ctx, channelID)
+func (cache *ChannelRepoCacheImpl) CreateChannel(ctx context.Context, channelID uint64, retentionSec int64, maxMembers int) (*Channel, error) {
+	return cache.channelRepo.CreateChannel(ctx, channelID, retentionSec, maxMembers)
 }
 func (cache *ChannelRepoCacheImpl) DeleteChannel(ctx context.Context, channelID uint64) error {
 	if err := cache.channelRepo.DeleteChannel(ctx, channelID); err != nil {
@@ -192,10 +453,66 @@ func (cache *ChannelRepoCacheImpl) DeleteChannel(ctx context.Context, channelID
 				Key: constructKey(channelUsersPrefix, channelID),
 			},
 		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(channelRetentionPrefix, channelID),
+			},
+		},
 	}
 	return cache.r.ExecPipeLine(ctx, &cmds)
 }
 
+// MarkTokenRefreshed records that the token has been exchanged and reports whether this is the first exchange
+func (cache *ChannelRepoCacheImpl) MarkTokenRefreshed(ctx context.Context, tokenID string, ttl time.Duration) (bool, error) {
+	return cache.r.SetNX(ctx, common.Join(tokenRefreshPrefix, ":", tokenID), 1, ttl)
+}
+func (cache *ChannelRepoCacheImpl) RevokeTokenFamily(ctx context.Context, family string, ttl time.Duration) error {
+	_, err := cache.r.SetNX(ctx, common.Join(tokenFamilyPrefix, ":", family), 1, ttl)
+	return err
+}
+func (cache *ChannelRepoCacheImpl) IsTokenFamilyRevoked(ctx context.Context, family string) (bool, error) {
+	var dummy int
+	return cache.r.Get(ctx, common.Join(tokenFamilyPrefix, ":", family), &dummy)
+}
+
+// RevokeChannel puts the channel on the deny-list until all of its access tokens have expired
+func (cache *ChannelRepoCacheImpl) RevokeChannel(ctx context.Context, channelID uint64, ttl time.Duration) error {
+	_, err := cache.r.SetNX(ctx, constructKey(channelRevokedPrefix, channelID), 1, ttl)
+	return err
+}
+func (cache *ChannelRepoCacheImpl) IsChannelRevoked(ctx context.Context, channelID uint64) (bool, error) {
+	var dummy int
+	return cache.r.Get(ctx, constructKey(channelRevokedPrefix, channelID), &dummy)
+}
+func (cache *ChannelRepoCacheImpl) PublishChannelEvent(ctx context.Context, event *ChannelEvent) error {
+	return cache.channelRepo.PublishChannelEvent(ctx, event)
+}
+
 func constructKey(prefix string, id uint64) string {
 	return common.Join(prefix, ":", strconv.FormatUint(id, 10))
 }
+
+func constructIdempotencyKey(channelID, userID uint64, key string) string {
+	return common.Join(idempotencyPrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10), ":", key)
+}
+
+func constructMessageRef(channelID, messageID uint64) string {
+	return common.Join(strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(messageID, 10))
+}
+
+func parseMessageRef(member string) (*MessageRef, error) {
+	channelIDStr, messageIDStr, ok := strings.Cut(member, ":")
+	if !ok {
+		return nil, fmt.Errorf("error invalid message ref %s", member)
+	}
+	channelID, err := strconv.ParseUint(channelIDStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := strconv.ParseUint(messageIDStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageRef{channelID, messageID}, nil
+}
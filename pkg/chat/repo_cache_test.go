@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/infra"
+)
+
+type fakeRedisCache struct {
+	infra.RedisCache
+	keys     map[string]bool
+	schedule map[string]bool
+}
+
+func newFakeRedisCache() *fakeRedisCache {
+	return &fakeRedisCache{
+		keys:     make(map[string]bool),
+		schedule: make(map[string]bool),
+	}
+}
+
+func (r *fakeRedisCache) Get(ctx context.Context, key string, dst interface{}) (bool, error) {
+	return r.keys[key], nil
+}
+
+func (r *fakeRedisCache) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	if r.keys[key] {
+		return false, nil
+	}
+	r.keys[key] = true
+	return true, nil
+}
+
+func (r *fakeRedisCache) Delete(ctx context.Context, key string) error {
+	delete(r.keys, key)
+	return nil
+}
+
+func (r *fakeRedisCache) ZLeaseByScore(ctx context.Context, key string, max float64, leaseUntil float64, count int64) ([]string, error) {
+	var members []string
+	for member := range r.schedule {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (r *fakeRedisCache) ZRemOne(ctx context.Context, key string, member interface{}) error {
+	delete(r.schedule, member.(string))
+	return nil
+}
+
+type fakeMessageRepo struct {
+	MessageRepo
+	decrements    int
+	decrementErrs []error
+	publishErrs   []error
+	expiries      int
+}
+
+func (repo *fakeMessageRepo) GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	return nil, ErrMessageNotFound
+}
+
+func (repo *fakeMessageRepo) ExpireMessage(ctx context.Context, channelID, messageID uint64) error {
+	repo.expiries++
+	return nil
+}
+
+func (repo *fakeMessageRepo) DecrementMessageCount(ctx context.Context, channelID uint64) error {
+	if len(repo.decrementErrs) > 0 {
+		err := repo.decrementErrs[0]
+		repo.decrementErrs = repo.decrementErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	repo.decrements++
+	return nil
+}
+
+func (repo *fakeMessageRepo) PublishMessage(ctx context.Context, msg *Message) error {
+	if len(repo.publishErrs) > 0 {
+		err := repo.publishErrs[0]
+		repo.publishErrs = repo.publishErrs[1:]
+		return err
+	}
+	return nil
+}
+
+func newTestLogger() common.HttpLog {
+	return common.HttpLog{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+func newTestMessageService(r *fakeRedisCache, repo *fakeMessageRepo) *MessageServiceImpl {
+	return &MessageServiceImpl{
+		logger:  newTestLogger(),
+		msgRepo: NewMessageRepoCacheImpl(r, repo),
+	}
+}
+
+func TestExpireMessagesDecrementsOnceAcrossRetries(t *testing.T) {
+	r := newFakeRedisCache()
+	r.schedule[constructMessageRef(1, 2)] = true
+	repo := &fakeMessageRepo{
+		publishErrs: []error{errors.New("publish failed")},
+	}
+	svc := newTestMessageService(r, repo)
+
+	// the first attempt fails after the message is deleted, so the expiry is left on the schedule
+	if _, err := svc.ExpireMessages(context.Background(), 10); err != nil {
+		t.Fatalf("first expiry: %v", err)
+	}
+	if !r.schedule[constructMessageRef(1, 2)] {
+		t.Fatal("failed expiry was acked")
+	}
+	if _, err := svc.ExpireMessages(context.Background(), 10); err != nil {
+		t.Fatalf("retried expiry: %v", err)
+	}
+	if r.schedule[constructMessageRef(1, 2)] {
+		t.Fatal("retried expiry was not acked")
+	}
+	if repo.expiries != 2 {
+		t.Fatalf("message deleted %d times, want 2", repo.expiries)
+	}
+	if repo.decrements != 1 {
+		t.Fatalf("counter decremented %d times, want 1", repo.decrements)
+	}
+}
+
+func TestExpireMessageRetriesFailedDecrement(t *testing.T) {
+	r := newFakeRedisCache()
+	repo := &fakeMessageRepo{
+		decrementErrs: []error{errors.New("decrement failed")},
+	}
+	cache := NewMessageRepoCacheImpl(r, repo)
+
+	if err := cache.ExpireMessage(context.Background(), 1, 2); err == nil {
+		t.Fatal("failed decrement was not reported")
+	}
+	if err := cache.ExpireMessage(context.Background(), 1, 2); err != nil {
+		t.Fatalf("retried expiry: %v", err)
+	}
+	if repo.decrements != 1 {
+		t.Fatalf("counter decremented %d times, want 1", repo.decrements)
+	}
+}
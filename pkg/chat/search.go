@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/minghsu0107/go-random-chat/pkg/infra"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	maxIndexedTerms    = 64
+	maxTermBytes       = 64
+	maxQueryTerms      = 8
+)
+
+var (
+	msgIndexPrefix      = "rc:msgidx"
+	msgIndexTermsPrefix = "rc:msgidxterms"
+)
+
+// MessageIndexer maintains the full-text index of text messages
+type MessageIndexer interface {
+	IndexMessage(ctx context.Context, msg *Message) error
+	RemoveMessage(ctx context.Context, msg *Message) error
+	RemoveChannel(ctx context.Context, channelID uint64) error
+	SearchMessageIDs(ctx context.Context, channelID uint64, query string, offset, limit int) ([]uint64, bool, error)
+}
+
+// MessageIndexerImpl is an inverted index in redis that keeps a sorted set of message IDs per channel term,
+// scored by the term frequency in each message. The terms of each channel are tracked so that its index
+// can be dropped with the channel, and index keys expire once no message has used them for the TTL
+type MessageIndexerImpl struct {
+	r   infra.RedisCache
+	ttl time.Duration
+}
+
+func NewMessageIndexerImpl(r infra.RedisCache, config *config.Config) *MessageIndexerImpl {
+	return &MessageIndexerImpl{r, time.Duration(config.Chat.Search.IndexTTLHour) * time.Hour}
+}
+
+// IndexMessage skips end-to-end encrypted messages, whose ciphertext has no searchable terms
+func (indexer *MessageIndexerImpl) IndexMessage(ctx context.Context, msg *Message) error {
+	if msg.Encryption != nil {
+		return nil
+	}
+	member := strconv.FormatUint(msg.MessageID, 10)
+	termsKey := constructKey(msgIndexTermsPrefix, msg.ChannelID)
+	for term, freq := range tokenize(msg.Payload, maxIndexedTerms) {
+		termKey := constructTermKey(msg.ChannelID, term)
+		if err := indexer.r.ZAddOne(ctx, termKey, float64(freq), member); err != nil {
+			return err
+		}
+		if err := indexer.r.Expire(ctx, termKey, indexer.ttl); err != nil {
+			return err
+		}
+		if err := indexer.r.HSet(ctx, termsKey, term, 1); err != nil {
+			return err
+		}
+	}
+	return indexer.r.Expire(ctx, termsKey, indexer.ttl)
+}
+func (indexer *MessageIndexerImpl) RemoveMessage(ctx context.Context, msg *Message) error {
+	if msg.Encryption != nil {
+		return nil
+	}
+	member := strconv.FormatUint(msg.MessageID, 10)
+	for term := range tokenize(msg.Payload, maxIndexedTerms) {
+		if err := indexer.r.ZRemOne(ctx, constructTermKey(msg.ChannelID, term), member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveChannel drops the whole index of a deleted channel
+func (indexer *MessageIndexerImpl) RemoveChannel(ctx context.Context, channelID uint64) error {
+	termsKey := constructKey(msgIndexTermsPrefix, channelID)
+	terms, err := indexer.r.HGetAll(ctx, termsKey)
+	if err != nil {
+		return err
+	}
+	for term := range terms {
+		if err := indexer.r.Delete(ctx, constructTermKey(channelID, term)); err != nil {
+			return err
+		}
+	}
+	return indexer.r.Delete(ctx, termsKey)
+}
+
+// SearchMessageIDs ranks messages by the number of matched query terms, then by the total term frequency,
+// and then by recency
+func (indexer *MessageIndexerImpl) SearchMessageIDs(ctx context.Context, channelID uint64, query string, offset, limit int) ([]uint64, bool, error) {
+	type hit struct {
+		messageID uint64
+		matched   int
+		score     float64
+	}
+	hits := make(map[uint64]*hit)
+	for term := range tokenize(query, maxQueryTerms) {
+		scores, err := indexer.r.ZRangeWithScores(ctx, constructTermKey(channelID, term), 0, -1)
+		if err != nil {
+			return nil, false, err
+		}
+		for member, score := range scores {
+			messageID, err := strconv.ParseUint(member, 10, 64)
+			if err != nil {
+				return nil, false, err
+			}
+			h, ok := hits[messageID]
+			if !ok {
+				h = &hit{messageID: messageID}
+				hits[messageID] = h
+			}
+			h.matched++
+			h.score += score
+		}
+	}
+	ranked := make([]*hit, 0, len(hits))
+	for _, h := range hits {
+		ranked = append(ranked, h)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].matched != ranked[j].matched {
+			return ranked[i].matched > ranked[j].matched
+		}
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].messageID > ranked[j].messageID
+	})
+	if offset >= len(ranked) {
+		return []uint64{}, false, nil
+	}
+	end := offset + limit
+	if end > len(ranked) {
+		end = len(ranked)
+	}
+	messageIDs := make([]uint64, 0, end-offset)
+	for _, h := range ranked[offset:end] {
+		messageIDs = append(messageIDs, h.messageID)
+	}
+	return messageIDs, end < len(ranked), nil
+}
+
+// tokenize lowercases the text and counts its terms. Words are split on non-alphanumeric runes
+// and each CJK character is a term on its own since those scripts are not space-delimited
+func tokenize(text string, maxTerms int) map[string]int {
+	terms := make(map[string]int)
+	add := func(term string) {
+		if term == "" || len(term) > maxTermBytes {
+			return
+		}
+		if _, ok := terms[term]; !ok && len(terms) >= maxTerms {
+			return
+		}
+		terms[term]++
+	}
+	var word strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			add(word.String())
+			word.Reset()
+			add(string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			add(word.String())
+			word.Reset()
+		}
+	}
+	add(word.String())
+	return terms
+}
+
+func constructTermKey(channelID uint64, term string) string {
+	return common.Join(constructKey(msgIndexPrefix, channelID), ":", term)
+}
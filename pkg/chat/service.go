@@ -2,22 +2,59 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const (
+	maxEmojiBytes   = 32
+	minRetentionSec = 10
+	// maxRetentionSec keeps message TTLs well below the cassandra limit of 20 years
+	maxRetentionSec   = 365 * 24 * 60 * 60
+	minMemberLimit    = 2
+	maxPinsPerChannel = 50
+	// maxIdempotencyKeyLen bounds the size of the redis keys of idempotent sends
+	maxIdempotencyKeyLen = 64
+	// bounds of the end-to-end encryption metadata and public keys, which the server cannot otherwise validate
+	maxEncryptionFieldLen = 128
+	maxPublicKeyLen       = 2048
+	// expireLeaseMs is how long an expiring message is held by a node before it is handed out again
+	expireLeaseMs = 60 * 1000
+	// maxUnreadCount caps the unread count of a read receipt, which bounds the messages scanned per member
+	maxUnreadCount = 99
 )
 
 type MessageService interface {
-	BroadcastTextMessage(ctx context.Context, channelID, userID uint64, payload string) error
+	BroadcastTextMessage(ctx context.Context, channelID, userID uint64, payload string, replyTo uint64, idempotencyKey string, encryption *Encryption) (*Message, error)
 	BroadcastConnectMessage(ctx context.Context, channelID, userID uint64) error
 	BroadcastActionMessage(ctx context.Context, channelID, userID uint64, action Action) error
-	BroadcastFileMessage(ctx context.Context, channelID, userID uint64, payload string) error
+	BroadcastFileMessage(ctx context.Context, channelID, userID uint64, payload string, replyTo uint64, idempotencyKey string, encryption *Encryption) (*Message, error)
+	EditMessage(ctx context.Context, channelID, userID, messageID uint64, payload string, encryption *Encryption) error
+	DeleteMessage(ctx context.Context, channelID, userID, messageID uint64) error
+	ReactMessage(ctx context.Context, channelID, userID, messageID uint64, reaction *Reaction) error
 	MarkMessageSeen(ctx context.Context, channelID, userID, messageID uint64) error
+	PublishPublicKey(ctx context.Context, channelID, userID uint64, key *PublicKey) error
+	GetPublicKeys(ctx context.Context, channelID uint64) ([]*PublicKey, error)
+	PinMessage(ctx context.Context, channelID, userID, messageID uint64) error
+	UnpinMessage(ctx context.Context, channelID, userID, messageID uint64) error
+	GetPinnedMessages(ctx context.Context, channelID uint64) ([]*PinnedMessage, error)
 	InsertMessage(ctx context.Context, msg *Message) error
 	PublishMessage(ctx context.Context, msg *Message) error
 	ListMessages(ctx context.Context, channelID uint64, pageState string) ([]*Message, string, error)
+	GetReadReceipts(ctx context.Context, channelID uint64, userIDs []uint64) ([]*ReadReceipt, error)
+	QueryMessages(ctx context.Context, channelID uint64, query *MessageQuery) ([]*Message, bool, error)
+	SearchMessages(ctx context.Context, channelID uint64, query string, offset, limit int) ([]*Message, bool, error)
+	ExportMessages(ctx context.Context, channelID uint64, fn func(*TranscriptMessage) error) error
+	GetChannelRetention(ctx context.Context, channelID uint64) (int64, error)
+	SetChannelRetention(ctx context.Context, channelID uint64, retentionSec int64) error
+	ExpireMessages(ctx context.Context, count int64) (int, error)
 }
 
 type UserService interface {
@@ -25,14 +62,21 @@ type UserService interface {
 	GetUser(ctx context.Context, userID uint64) (*User, error)
 	IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error)
 	GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	GetChannelMemberIDs(ctx context.Context, channelID uint64) ([]uint64, error)
 	AddOnlineUser(ctx context.Context, channelID, userID uint64) error
 	DeleteOnlineUser(ctx context.Context, channelID, userID uint64) error
 	GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	RemoveUserFromChannel(ctx context.Context, channelID, userID uint64) (int, error)
+	GetChannelMemberLimit(ctx context.Context, channelID uint64) (int, error)
+	SetChannelMemberLimit(ctx context.Context, channelID uint64, maxMembers int) error
 }
 
 type ChannelService interface {
-	CreateChannel(ctx context.Context) (*Channel, error)
+	CreateChannel(ctx context.Context, retentionSec int64, maxMembers int) (*Channel, error)
 	DeleteChannel(ctx context.Context, channelID uint64) error
+	RefreshChannelToken(ctx context.Context, accessToken string, userID uint64) (*Channel, error)
+	IsChannelRevoked(ctx context.Context, channelID uint64) (bool, error)
+	IsTokenRevoked(ctx context.Context, channelID uint64, family string) (bool, error)
 }
 
 type ForwardService interface {
@@ -41,44 +85,79 @@ type ForwardService interface {
 }
 
 type MessageServiceImpl struct {
-	msgRepo  MessageRepoCache
-	userRepo UserRepoCache
-	sf       common.IDGenerator
+	logger            common.HttpLog
+	msgRepo           MessageRepoCache
+	userRepo          UserRepoCache
+	msgIndexer        MessageIndexer
+	moderator         *MessageModerator
+	sf                common.IDGenerator
+	idempotencyWindow time.Duration
 }
 
-func NewMessageServiceImpl(msgRepo MessageRepoCache, userRepo UserRepoCache, sf common.IDGenerator) *MessageServiceImpl {
-	return &MessageServiceImpl{msgRepo, userRepo, sf}
-}
-func (svc *MessageServiceImpl) BroadcastTextMessage(ctx context.Context, channelID, userID uint64, payload string) error {
-	messageID, err := svc.sf.NextID()
-	if err != nil {
-		return fmt.Errorf("error create snowflake ID for text message: %w", err)
-	}
-	msg := Message{
-		MessageID: messageID,
-		Event:     EventText,
-		ChannelID: channelID,
-		UserID:    userID,
-		Payload:   payload,
-		Time:      time.Now().UnixMilli(),
-	}
-	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast text message: %w", err)
+func NewMessageServiceImpl(logger common.HttpLog, config *config.Config, msgRepo MessageRepoCache, userRepo UserRepoCache, msgIndexer MessageIndexer, moderator *MessageModerator, sf common.IDGenerator) *MessageServiceImpl {
+	return &MessageServiceImpl{
+		logger:            logger,
+		msgRepo:           msgRepo,
+		userRepo:          userRepo,
+		msgIndexer:        msgIndexer,
+		moderator:         moderator,
+		sf:                sf,
+		idempotencyWindow: time.Duration(config.Chat.Message.IdempotencyWindowSec) * time.Second,
 	}
-	if err := svc.PublishMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast text message: %w", err)
+}
+func (svc *MessageServiceImpl) BroadcastTextMessage(ctx context.Context, channelID, userID uint64, payload string, replyTo uint64, idempotencyKey string, encryption *Encryption) (*Message, error) {
+	if err := validateEncryption(encryption); err != nil {
+		return nil, fmt.Errorf("error broadcast text message: %w", err)
 	}
-	return nil
+	return svc.sendIdempotent(ctx, channelID, userID, idempotencyKey, func(messageID uint64) (*Message, error) {
+		quote, err := svc.getQuote(ctx, channelID, replyTo)
+		if err != nil {
+			return nil, fmt.Errorf("error broadcast text message: %w", err)
+		}
+		msg := Message{
+			MessageID:  messageID,
+			Event:      EventText,
+			ChannelID:  channelID,
+			UserID:     userID,
+			Payload:    payload,
+			Time:       time.Now().UnixMilli(),
+			ReplyTo:    replyTo,
+			Quote:      quote,
+			Encryption: encryption,
+		}
+		if err := svc.moderator.Moderate(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast text message: %w", err)
+		}
+		if err := svc.setExpireAt(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast text message: %w", err)
+		}
+		if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast text message: %w", err)
+		}
+		if err := svc.PublishMessage(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast text message: %w", err)
+		}
+		// the message is already delivered, so a failure to index it only affects search
+		if err := svc.msgIndexer.IndexMessage(ctx, &msg); err != nil {
+			svc.logger.Error(fmt.Sprintf("error index text message %d: %v", messageID, err))
+		}
+		return &msg, nil
+	})
 }
+
+// BroadcastConnectMessage tells the channel that the user is waiting if nobody else is online,
+// or that the user has joined the members who are online
 func (svc *MessageServiceImpl) BroadcastConnectMessage(ctx context.Context, channelID, userID uint64) error {
-	onnlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(context.Background(), channelID)
+	onlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
 	if err != nil {
 		return fmt.Errorf("error get online user ids from channel %d: %w", channelID, err)
 	}
-	if len(onnlineUserIDs) == 1 {
-		return svc.BroadcastActionMessage(ctx, channelID, userID, WaitingMessage)
+	for _, onlineUserID := range onlineUserIDs {
+		if onlineUserID != userID {
+			return svc.BroadcastActionMessage(ctx, channelID, userID, JoinedMessage)
+		}
 	}
-	return svc.BroadcastActionMessage(ctx, channelID, userID, JoinedMessage)
+	return svc.BroadcastActionMessage(ctx, channelID, userID, WaitingMessage)
 }
 func (svc *MessageServiceImpl) BroadcastActionMessage(ctx context.Context, channelID, userID uint64, action Action) error {
 	eventMessageID, err := svc.sf.NextID()
@@ -93,36 +172,365 @@ func (svc *MessageServiceImpl) BroadcastActionMessage(ctx context.Context, chann
 		Payload:   string(action),
 		Time:      time.Now().UnixMilli(),
 	}
+	if IsEphemeralAction(action) {
+		if err := svc.msgRepo.PublishEphemeralMessage(ctx, &msg); err != nil {
+			return fmt.Errorf("error broadcast ephemeral action message: %w", err)
+		}
+		return nil
+	}
 	if err := svc.PublishMessage(ctx, &msg); err != nil {
 		return fmt.Errorf("error broadcast action message: %w", err)
 	}
 	return nil
 }
-func (svc *MessageServiceImpl) BroadcastFileMessage(ctx context.Context, channelID, userID uint64, payload string) error {
+func (svc *MessageServiceImpl) BroadcastFileMessage(ctx context.Context, channelID, userID uint64, payload string, replyTo uint64, idempotencyKey string, encryption *Encryption) (*Message, error) {
+	if err := validateEncryption(encryption); err != nil {
+		return nil, fmt.Errorf("error broadcast file message: %w", err)
+	}
+	return svc.sendIdempotent(ctx, channelID, userID, idempotencyKey, func(messageID uint64) (*Message, error) {
+		quote, err := svc.getQuote(ctx, channelID, replyTo)
+		if err != nil {
+			return nil, fmt.Errorf("error broadcast file message: %w", err)
+		}
+		msg := Message{
+			MessageID:  messageID,
+			Event:      EventFile,
+			ChannelID:  channelID,
+			UserID:     userID,
+			Payload:    payload,
+			Time:       time.Now().UnixMilli(),
+			ReplyTo:    replyTo,
+			Quote:      quote,
+			Encryption: encryption,
+		}
+		if err := svc.moderator.Moderate(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast file message: %w", err)
+		}
+		if err := svc.setExpireAt(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast file message: %w", err)
+		}
+		if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast file message: %w", err)
+		}
+		if err := svc.PublishMessage(ctx, &msg); err != nil {
+			return nil, fmt.Errorf("error broadcast file message: %w", err)
+		}
+		return &msg, nil
+	})
+}
+
+// sendIdempotent sends a message with a new ID. If the sender has used the idempotency key in the window,
+// the message stored by the first send is returned instead of sending a duplicate
+func (svc *MessageServiceImpl) sendIdempotent(ctx context.Context, channelID, userID uint64, idempotencyKey string, send func(messageID uint64) (*Message, error)) (*Message, error) {
 	messageID, err := svc.sf.NextID()
 	if err != nil {
-		return fmt.Errorf("error create snowflake ID for file message: %w", err)
+		return nil, fmt.Errorf("error create snowflake ID for message: %w", err)
 	}
-	msg := Message{
+	if idempotencyKey == "" {
+		return send(messageID)
+	}
+	if len(idempotencyKey) > maxIdempotencyKeyLen {
+		return nil, ErrInvalidIdempotencyKey
+	}
+	storedID, reserved, err := svc.msgRepo.ReserveIdempotencyKey(ctx, channelID, userID, idempotencyKey, messageID, svc.idempotencyWindow)
+	if err != nil {
+		return nil, fmt.Errorf("error reserve idempotency key of user %d: %w", userID, err)
+	}
+	if !reserved {
+		msg, err := svc.msgRepo.GetMessage(ctx, channelID, storedID)
+		if err != nil {
+			if errors.Is(err, ErrMessageNotFound) {
+				return nil, fmt.Errorf("error resend message %d: %w", storedID, ErrSendInProgress)
+			}
+			return nil, fmt.Errorf("error get message %d in channel %d: %w", storedID, channelID, err)
+		}
+		return msg, nil
+	}
+	msg, sendErr := send(messageID)
+	if sendErr == nil {
+		return msg, nil
+	}
+	// free the key for a retry unless the message has been stored before the failure
+	if _, err := svc.msgRepo.GetMessage(ctx, channelID, messageID); errors.Is(err, ErrMessageNotFound) {
+		if err := svc.msgRepo.ReleaseIdempotencyKey(ctx, channelID, userID, idempotencyKey); err != nil {
+			return nil, fmt.Errorf("error release idempotency key of user %d: %w", userID, err)
+		}
+	}
+	return nil, sendErr
+}
+func (svc *MessageServiceImpl) EditMessage(ctx context.Context, channelID, userID, messageID uint64, payload string, encryption *Encryption) error {
+	if err := validateEncryption(encryption); err != nil {
+		return fmt.Errorf("error edit message %d by user %d: %w", messageID, userID, err)
+	}
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.UserID != userID {
+		return fmt.Errorf("error edit message %d by user %d: %w", messageID, userID, ErrMessageNotOwned)
+	}
+	if msg.Event != EventText || msg.Deleted {
+		return fmt.Errorf("error edit message %d by user %d: %w", messageID, userID, ErrMessageNotEditable)
+	}
+	edited := *msg
+	edited.Payload = payload
+	edited.Encryption = encryption
+	if err := svc.moderator.Moderate(ctx, &edited); err != nil {
+		return fmt.Errorf("error edit message %d by user %d: %w", messageID, userID, err)
+	}
+	payload = edited.Payload
+	editedAt := time.Now().UnixMilli()
+	if err := svc.msgRepo.UpdateMessagePayload(ctx, channelID, messageID, payload, encryption, editedAt); err != nil {
+		return fmt.Errorf("error edit message %d in channel %d: %w", messageID, channelID, err)
+	}
+	original := *msg
+	msg.Event = EventEdit
+	msg.Payload = payload
+	msg.Encryption = encryption
+	msg.EditedAt = editedAt
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error edit message %d in channel %d: %w", messageID, channelID, err)
+	}
+	// the edit is already stored and delivered, so a failure to reindex it only affects search
+	if err := svc.msgIndexer.RemoveMessage(ctx, &original); err != nil {
+		svc.logger.Error(fmt.Sprintf("error remove message %d from index: %v", messageID, err))
+	} else if err := svc.msgIndexer.IndexMessage(ctx, msg); err != nil {
+		svc.logger.Error(fmt.Sprintf("error index message %d: %v", messageID, err))
+	}
+	return nil
+}
+func (svc *MessageServiceImpl) DeleteMessage(ctx context.Context, channelID, userID, messageID uint64) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.UserID != userID {
+		return fmt.Errorf("error delete message %d by user %d: %w", messageID, userID, ErrMessageNotOwned)
+	}
+	if (msg.Event != EventText && msg.Event != EventFile) || msg.Deleted {
+		return fmt.Errorf("error delete message %d by user %d: %w", messageID, userID, ErrMessageNotDeletable)
+	}
+	if err := svc.msgRepo.TombstoneMessage(ctx, channelID, messageID); err != nil {
+		return fmt.Errorf("error delete message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if err := svc.msgRepo.DeletePin(ctx, channelID, messageID); err != nil {
+		return fmt.Errorf("error unpin message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.Event == EventText {
+		// search results skip deleted messages, so a stale index entry is harmless
+		if err := svc.msgIndexer.RemoveMessage(ctx, msg); err != nil {
+			svc.logger.Error(fmt.Sprintf("error remove message %d from index: %v", messageID, err))
+		}
+	}
+	msg.Event = EventDelete
+	msg.Payload = ""
+	msg.Deleted = true
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error delete message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
+}
+func (svc *MessageServiceImpl) ReactMessage(ctx context.Context, channelID, userID, messageID uint64, reaction *Reaction) error {
+	if reaction.Emoji == "" || len(reaction.Emoji) > maxEmojiBytes {
+		return fmt.Errorf("error react to message %d by user %d: %w", messageID, userID, ErrInvalidReaction)
+	}
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.Deleted {
+		return fmt.Errorf("error react to message %d by user %d: %w", messageID, userID, ErrMessageNotFound)
+	}
+	switch reaction.Op {
+	case ReactionAdd:
+		err = svc.msgRepo.AddReaction(ctx, channelID, messageID, userID, reaction.Emoji)
+	case ReactionRemove:
+		err = svc.msgRepo.RemoveReaction(ctx, channelID, messageID, userID, reaction.Emoji)
+	default:
+		return fmt.Errorf("error react to message %d by user %d: %w", messageID, userID, ErrInvalidReaction)
+	}
+	if err != nil {
+		return fmt.Errorf("error react to message %d in channel %d: %w", messageID, channelID, err)
+	}
+	counts, err := svc.msgRepo.GetReactionCounts(ctx, channelID, []uint64{messageID})
+	if err != nil {
+		return fmt.Errorf("error get reactions of message %d in channel %d: %w", messageID, channelID, err)
+	}
+	payload, _ := json.Marshal(reaction)
+	msg = &Message{
 		MessageID: messageID,
-		Event:     EventFile,
+		Event:     EventReaction,
 		ChannelID: channelID,
 		UserID:    userID,
-		Payload:   payload,
+		Payload:   string(payload),
 		Time:      time.Now().UnixMilli(),
+		Reactions: counts[messageID],
 	}
-	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast file message: %w", err)
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error broadcast reaction to message %d in channel %d: %w", messageID, channelID, err)
 	}
-	if err := svc.PublishMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast file message: %w", err)
+	return nil
+}
+
+// PublishPublicKey stores the end-to-end encryption public key of the member and relays it to the channel,
+// replacing the key the member has published before
+func (svc *MessageServiceImpl) PublishPublicKey(ctx context.Context, channelID, userID uint64, key *PublicKey) error {
+	if key.Algorithm == "" || len(key.Algorithm) > maxEncryptionFieldLen || key.Key == "" || len(key.Key) > maxPublicKeyLen {
+		return fmt.Errorf("error publish public key of user %d: %w", userID, ErrInvalidPublicKey)
+	}
+	key.UserID = userID
+	key.UpdatedAt = time.Now().UnixMilli()
+	if err := svc.msgRepo.UpsertPublicKey(ctx, channelID, key); err != nil {
+		return fmt.Errorf("error publish public key of user %d in channel %d: %w", userID, channelID, err)
+	}
+	payload, _ := json.Marshal(key)
+	if err := svc.PublishMessage(ctx, &Message{
+		Event:     EventKeyExchange,
+		ChannelID: channelID,
+		UserID:    userID,
+		Payload:   string(payload),
+		Time:      key.UpdatedAt,
+	}); err != nil {
+		return fmt.Errorf("error broadcast public key of user %d in channel %d: %w", userID, channelID, err)
 	}
 	return nil
 }
+func (svc *MessageServiceImpl) GetPublicKeys(ctx context.Context, channelID uint64) ([]*PublicKey, error) {
+	keys, err := svc.msgRepo.GetPublicKeys(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get public keys in channel %d: %w", channelID, err)
+	}
+	return keys, nil
+}
+
+// PinMessage pins a text or file message of the channel and broadcasts the pin
+// with a snapshot of the message. Pinning a pinned message does nothing
+func (svc *MessageServiceImpl) PinMessage(ctx context.Context, channelID, userID, messageID uint64) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if (msg.Event != EventText && msg.Event != EventFile) || msg.Deleted {
+		return fmt.Errorf("error pin message %d by user %d: %w", messageID, userID, ErrMessageNotPinnable)
+	}
+	pins, err := svc.msgRepo.GetPins(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get pins in channel %d: %w", channelID, err)
+	}
+	for _, pin := range pins {
+		if pin.MessageID == messageID {
+			return nil
+		}
+	}
+	if len(pins) >= maxPinsPerChannel {
+		return fmt.Errorf("error pin message %d in channel %d: %w", messageID, channelID, ErrTooManyPins)
+	}
+	now := time.Now().UnixMilli()
+	if err := svc.msgRepo.InsertPin(ctx, &Pin{
+		ChannelID: channelID,
+		MessageID: messageID,
+		PinnedBy:  userID,
+		PinnedAt:  now,
+	}); err != nil {
+		return fmt.Errorf("error pin message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if err := svc.PublishMessage(ctx, &Message{
+		MessageID: messageID,
+		Event:     EventPin,
+		ChannelID: channelID,
+		UserID:    userID,
+		Time:      now,
+		Quote:     msg.ToQuote(),
+	}); err != nil {
+		return fmt.Errorf("error broadcast pin of message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
+}
+func (svc *MessageServiceImpl) UnpinMessage(ctx context.Context, channelID, userID, messageID uint64) error {
+	pins, err := svc.msgRepo.GetPins(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get pins in channel %d: %w", channelID, err)
+	}
+	pinned := false
+	for _, pin := range pins {
+		if pin.MessageID == messageID {
+			pinned = true
+			break
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("error unpin message %d by user %d: %w", messageID, userID, ErrMessageNotPinned)
+	}
+	if err := svc.msgRepo.DeletePin(ctx, channelID, messageID); err != nil {
+		return fmt.Errorf("error unpin message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if err := svc.PublishMessage(ctx, &Message{
+		MessageID: messageID,
+		Event:     EventUnpin,
+		ChannelID: channelID,
+		UserID:    userID,
+		Time:      time.Now().UnixMilli(),
+	}); err != nil {
+		return fmt.Errorf("error broadcast unpin of message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
+}
+
+// GetPinnedMessages returns the pinned messages of the channel, most recently pinned first
+func (svc *MessageServiceImpl) GetPinnedMessages(ctx context.Context, channelID uint64) ([]*PinnedMessage, error) {
+	pins, err := svc.msgRepo.GetPins(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get pins in channel %d: %w", channelID, err)
+	}
+	messageIDs := make([]uint64, len(pins))
+	for i, pin := range pins {
+		messageIDs[i] = pin.MessageID
+	}
+	msgs, err := svc.msgRepo.GetMessagesByIDs(ctx, channelID, messageIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error get pinned messages in channel %d: %w", channelID, err)
+	}
+	if err := svc.attachReactions(ctx, channelID, msgs); err != nil {
+		return nil, err
+	}
+	if err := svc.attachQuotes(ctx, channelID, msgs); err != nil {
+		return nil, err
+	}
+	msgByID := make(map[uint64]*Message, len(msgs))
+	for _, msg := range msgs {
+		msgByID[msg.MessageID] = msg
+	}
+	var pinnedMsgs []*PinnedMessage
+	for _, pin := range pins {
+		// skip pins whose message has expired
+		msg, ok := msgByID[pin.MessageID]
+		if !ok || msg.Deleted {
+			continue
+		}
+		pinnedMsgs = append(pinnedMsgs, &PinnedMessage{
+			Message:  msg,
+			PinnedBy: pin.PinnedBy,
+			PinnedAt: pin.PinnedAt,
+		})
+	}
+	sort.Slice(pinnedMsgs, func(i, j int) bool {
+		return pinnedMsgs[i].PinnedAt > pinnedMsgs[j].PinnedAt
+	})
+	return pinnedMsgs, nil
+}
+
+// MarkMessageSeen moves the read watermark of the user to the message and broadcasts the change
 func (svc *MessageServiceImpl) MarkMessageSeen(ctx context.Context, channelID, userID, messageID uint64) error {
-	if err := svc.msgRepo.MarkMessageSeen(ctx, channelID, messageID); err != nil {
+	if _, err := svc.msgRepo.GetMessage(ctx, channelID, messageID); err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	advanced, err := svc.msgRepo.UpdateReadWatermark(ctx, channelID, userID, messageID)
+	if err != nil {
 		return fmt.Errorf("error mark message %d seen in channel %d: %w", messageID, channelID, err)
 	}
+	if !advanced {
+		return nil
+	}
 	eventMessageID, err := svc.sf.NextID()
 	if err != nil {
 		return fmt.Errorf("error create snowflake ID for seen event message: %w", err)
@@ -158,20 +566,350 @@ func (svc *MessageServiceImpl) ListMessages(ctx context.Context, channelID uint6
 	if err != nil {
 		return nil, "", fmt.Errorf("error list messages in channel %d with page state %s: %w", channelID, pageState, err)
 	}
+	if err := svc.attachReactions(ctx, channelID, msgs); err != nil {
+		return nil, "", err
+	}
+	if err := svc.attachQuotes(ctx, channelID, msgs); err != nil {
+		return nil, "", err
+	}
+	if err := svc.attachSeen(ctx, channelID, msgs); err != nil {
+		return nil, "", err
+	}
 	return msgs, nextPageState, nil
 }
+func (svc *MessageServiceImpl) QueryMessages(ctx context.Context, channelID uint64, query *MessageQuery) ([]*Message, bool, error) {
+	msgs, hasMore, err := svc.msgRepo.QueryMessages(ctx, channelID, query)
+	if err != nil {
+		return nil, false, fmt.Errorf("error query messages in channel %d: %w", channelID, err)
+	}
+	if err := svc.attachReactions(ctx, channelID, msgs); err != nil {
+		return nil, false, err
+	}
+	if err := svc.attachQuotes(ctx, channelID, msgs); err != nil {
+		return nil, false, err
+	}
+	if err := svc.attachSeen(ctx, channelID, msgs); err != nil {
+		return nil, false, err
+	}
+	return msgs, hasMore, nil
+}
+
+// SearchMessages returns the text messages matching the query in ranked order
+func (svc *MessageServiceImpl) SearchMessages(ctx context.Context, channelID uint64, query string, offset, limit int) ([]*Message, bool, error) {
+	messageIDs, hasMore, err := svc.msgIndexer.SearchMessageIDs(ctx, channelID, query, offset, limit)
+	if err != nil {
+		return nil, false, fmt.Errorf("error search messages in channel %d: %w", channelID, err)
+	}
+	foundMsgs, err := svc.msgRepo.GetMessagesByIDs(ctx, channelID, messageIDs)
+	if err != nil {
+		return nil, false, fmt.Errorf("error get searched messages in channel %d: %w", channelID, err)
+	}
+	msgMap := make(map[uint64]*Message)
+	for _, msg := range foundMsgs {
+		msgMap[msg.MessageID] = msg
+	}
+	msgs := []*Message{}
+	for _, messageID := range messageIDs {
+		if msg, ok := msgMap[messageID]; ok && !msg.Deleted {
+			msgs = append(msgs, msg)
+		}
+	}
+	if err := svc.attachReactions(ctx, channelID, msgs); err != nil {
+		return nil, false, err
+	}
+	if err := svc.attachQuotes(ctx, channelID, msgs); err != nil {
+		return nil, false, err
+	}
+	if err := svc.attachSeen(ctx, channelID, msgs); err != nil {
+		return nil, false, err
+	}
+	return msgs, hasMore, nil
+}
+
+// ExportMessages streams the whole channel history from the oldest message with sender names and file links resolved
+func (svc *MessageServiceImpl) ExportMessages(ctx context.Context, channelID uint64, fn func(*TranscriptMessage) error) error {
+	userNames := make(map[uint64]string)
+	err := svc.msgRepo.StreamMessages(ctx, channelID, func(msg *Message) error {
+		userName, ok := userNames[msg.UserID]
+		if !ok {
+			user, err := svc.userRepo.GetUserByID(ctx, msg.UserID)
+			if err != nil && !errors.Is(err, ErrUserNotFound) {
+				return fmt.Errorf("error get user %d: %w", msg.UserID, err)
+			}
+			if user != nil {
+				userName = user.Name
+			}
+			userNames[msg.UserID] = userName
+		}
+		transcriptMsg := TranscriptMessage{
+			MessageID: msg.MessageID,
+			Event:     msg.Event,
+			UserID:    msg.UserID,
+			UserName:  userName,
+			Payload:   msg.Payload,
+			Time:      msg.Time,
+			EditedAt:  msg.EditedAt,
+			Deleted:   msg.Deleted,
+			ReplyTo:   msg.ReplyTo,
+		}
+		if msg.Encryption != nil {
+			transcriptMsg.Encrypted = true
+		} else if msg.Event == EventFile && !msg.Deleted {
+			var file FilePayload
+			if err := json.Unmarshal([]byte(msg.Payload), &file); err == nil {
+				transcriptMsg.FileName = file.FileName
+				transcriptMsg.FileURL = getFileLink(&file)
+			}
+		}
+		return fn(&transcriptMsg)
+	})
+	if err != nil {
+		return fmt.Errorf("error export messages in channel %d: %w", channelID, err)
+	}
+	return nil
+}
+
+func (svc *MessageServiceImpl) GetChannelRetention(ctx context.Context, channelID uint64) (int64, error) {
+	retentionSec, err := svc.msgRepo.GetChannelRetention(ctx, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("error get retention of channel %d: %w", channelID, err)
+	}
+	return retentionSec, nil
+}
+
+// SetChannelRetention sets how long new messages in the channel are kept. Zero resets it to the default
+func (svc *MessageServiceImpl) SetChannelRetention(ctx context.Context, channelID uint64, retentionSec int64) error {
+	if !isValidRetention(retentionSec) {
+		return ErrInvalidRetention
+	}
+	if err := svc.msgRepo.SetChannelRetention(ctx, channelID, retentionSec); err != nil {
+		return fmt.Errorf("error set retention of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+
+// ExpireMessages removes at most count messages whose retention is over and tells the channels to drop them.
+// It returns the number of messages taken off the expiry schedule. A message that fails to expire
+// is logged and retried once its lease ends, without holding up the rest of the batch
+func (svc *MessageServiceImpl) ExpireMessages(ctx context.Context, count int64) (int, error) {
+	now := time.Now().UnixMilli()
+	refs, err := svc.msgRepo.LeaseExpiredMessages(ctx, now, now+expireLeaseMs, count)
+	if err != nil {
+		return 0, fmt.Errorf("error lease expired messages: %w", err)
+	}
+	for _, ref := range refs {
+		if err := svc.expireMessage(ctx, ref, now); err != nil {
+			svc.logger.Error(err.Error())
+		}
+	}
+	return len(refs), nil
+}
+
+func (svc *MessageServiceImpl) expireMessage(ctx context.Context, ref *MessageRef, now int64) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, ref.ChannelID, ref.MessageID)
+	if err != nil && !errors.Is(err, ErrMessageNotFound) {
+		return fmt.Errorf("error get message %d in channel %d: %w", ref.MessageID, ref.ChannelID, err)
+	}
+	// the message is already gone if the cassandra TTL has passed
+	if msg != nil && msg.Event == EventText && !msg.Deleted {
+		if err := svc.msgIndexer.RemoveMessage(ctx, msg); err != nil {
+			return fmt.Errorf("error remove message %d from index: %w", ref.MessageID, err)
+		}
+	}
+	if err := svc.msgRepo.ExpireMessage(ctx, ref.ChannelID, ref.MessageID); err != nil {
+		return fmt.Errorf("error expire message %d in channel %d: %w", ref.MessageID, ref.ChannelID, err)
+	}
+	expireMsg := Message{
+		MessageID: ref.MessageID,
+		Event:     EventExpire,
+		ChannelID: ref.ChannelID,
+		Time:      now,
+	}
+	if msg != nil {
+		expireMsg.UserID = msg.UserID
+	}
+	if err := svc.PublishMessage(ctx, &expireMsg); err != nil {
+		return fmt.Errorf("error broadcast expiry of message %d in channel %d: %w", ref.MessageID, ref.ChannelID, err)
+	}
+	if err := svc.msgRepo.AckExpiredMessage(ctx, ref); err != nil {
+		return fmt.Errorf("error ack expiry of message %d in channel %d: %w", ref.MessageID, ref.ChannelID, err)
+	}
+	return nil
+}
+
+// GetReadReceipts returns the last seen message and the unread count of each user.
+// Unread counts above maxUnreadCount are reported as maxUnreadCount and marked as capped
+func (svc *MessageServiceImpl) GetReadReceipts(ctx context.Context, channelID uint64, userIDs []uint64) ([]*ReadReceipt, error) {
+	watermarks, err := svc.msgRepo.GetReadWatermarks(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get read watermarks in channel %d: %w", channelID, err)
+	}
+	var receipts []*ReadReceipt
+	for _, userID := range userIDs {
+		lastSeenMessageID := watermarks[userID]
+		unreadCount, err := svc.msgRepo.CountUnreadMessages(ctx, channelID, userID, lastSeenMessageID, maxUnreadCount+1)
+		if err != nil {
+			return nil, fmt.Errorf("error count unread messages of user %d in channel %d: %w", userID, channelID, err)
+		}
+		receipt := &ReadReceipt{
+			UserID:            userID,
+			LastSeenMessageID: lastSeenMessageID,
+			UnreadCount:       unreadCount,
+		}
+		if unreadCount > maxUnreadCount {
+			receipt.UnreadCount = maxUnreadCount
+			receipt.UnreadCapped = true
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+func (svc *MessageServiceImpl) attachReactions(ctx context.Context, channelID uint64, msgs []*Message) error {
+	var messageIDs []uint64
+	for _, msg := range msgs {
+		if msg.Event == EventText || msg.Event == EventFile {
+			messageIDs = append(messageIDs, msg.MessageID)
+		}
+	}
+	counts, err := svc.msgRepo.GetReactionCounts(ctx, channelID, messageIDs)
+	if err != nil {
+		return fmt.Errorf("error get reactions in channel %d: %w", channelID, err)
+	}
+	for _, msg := range msgs {
+		msg.Reactions = counts[msg.MessageID]
+	}
+	return nil
+}
+
+func (svc *MessageServiceImpl) attachQuotes(ctx context.Context, channelID uint64, msgs []*Message) error {
+	var replyTos []uint64
+	for _, msg := range msgs {
+		if msg.ReplyTo != 0 {
+			replyTos = append(replyTos, msg.ReplyTo)
+		}
+	}
+	quotedMsgs, err := svc.msgRepo.GetMessagesByIDs(ctx, channelID, replyTos)
+	if err != nil {
+		return fmt.Errorf("error get quoted messages in channel %d: %w", channelID, err)
+	}
+	quotes := make(map[uint64]*Quote)
+	for _, quotedMsg := range quotedMsgs {
+		quotes[quotedMsg.MessageID] = quotedMsg.ToQuote()
+	}
+	for _, msg := range msgs {
+		if msg.ReplyTo != 0 {
+			msg.Quote = quotes[msg.ReplyTo]
+		}
+	}
+	return nil
+}
+
+// attachSeen counts the participants other than the sender who have seen each message,
+// and marks messages that have been seen by any of them
+func (svc *MessageServiceImpl) attachSeen(ctx context.Context, channelID uint64, msgs []*Message) error {
+	watermarks, err := svc.msgRepo.GetReadWatermarks(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get read watermarks in channel %d: %w", channelID, err)
+	}
+	for _, msg := range msgs {
+		for userID, lastSeenMessageID := range watermarks {
+			if userID != msg.UserID && lastSeenMessageID >= msg.MessageID {
+				msg.SeenBy++
+			}
+		}
+		msg.Seen = msg.SeenBy > 0
+	}
+	return nil
+}
+
+// setExpireAt sets the expiry time of a message according to the retention of its channel
+func (svc *MessageServiceImpl) setExpireAt(ctx context.Context, msg *Message) error {
+	retentionSec, err := svc.msgRepo.GetChannelRetention(ctx, msg.ChannelID)
+	if err != nil {
+		return fmt.Errorf("error get retention of channel %d: %w", msg.ChannelID, err)
+	}
+	if retentionSec > 0 {
+		msg.ExpireAt = msg.Time + retentionSec*1000
+	}
+	return nil
+}
+
+// getQuote checks that the replied message exists in the channel and returns its snapshot
+func (svc *MessageServiceImpl) getQuote(ctx context.Context, channelID, replyTo uint64) (*Quote, error) {
+	if replyTo == 0 {
+		return nil, nil
+	}
+	quotedMsg, err := svc.msgRepo.GetMessage(ctx, channelID, replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("error get replied message %d in channel %d: %w", replyTo, channelID, err)
+	}
+	if quotedMsg.Event != EventText && quotedMsg.Event != EventFile {
+		return nil, ErrInvalidReplyTarget
+	}
+	if quotedMsg.Deleted {
+		quotedMsg.Payload = ""
+	}
+	return quotedMsg.ToQuote(), nil
+}
+
+// validateEncryption checks the metadata of an end-to-end encrypted payload, where nil means plaintext
+func validateEncryption(encryption *Encryption) error {
+	if encryption == nil {
+		return nil
+	}
+	if encryption.Algorithm == "" || encryption.Nonce == "" ||
+		len(encryption.Algorithm) > maxEncryptionFieldLen || len(encryption.Nonce) > maxEncryptionFieldLen || len(encryption.KeyID) > maxEncryptionFieldLen {
+		return ErrInvalidEncryption
+	}
+	return nil
+}
 
 type UserServiceImpl struct {
-	userRepo UserRepoCache
+	logger     common.HttpLog
+	userRepo   UserRepoCache
+	chanRepo   ChannelRepoCache
+	maxMembers int
 }
 
-func NewUserServiceImpl(userRepo UserRepoCache) *UserServiceImpl {
-	return &UserServiceImpl{userRepo}
+func NewUserServiceImpl(logger common.HttpLog, config *config.Config, userRepo UserRepoCache, chanRepo ChannelRepoCache) *UserServiceImpl {
+	return &UserServiceImpl{
+		logger:     logger,
+		userRepo:   userRepo,
+		chanRepo:   chanRepo,
+		maxMembers: config.Chat.Channel.MaxMembers,
+	}
 }
+
+// AddUserToChannel adds the user to the channel unless the channel has reached its member limit,
+// which is enforced atomically against concurrent joins, and publishes a UserJoined event. Adding an existing member does nothing
 func (svc *UserServiceImpl) AddUserToChannel(ctx context.Context, channelID, userID uint64) error {
-	if err := svc.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
+	exist, err := svc.IsChannelUserExist(ctx, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+	maxMembers, err := svc.GetChannelMemberLimit(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	if err := svc.userRepo.AddUserToChannelWithLimit(ctx, channelID, userID, maxMembers); err != nil {
+		if errors.Is(err, ErrChannelFull) {
+			return ErrChannelFull
+		}
 		return fmt.Errorf("error add user %d to channel %d: %w", userID, channelID, err)
 	}
+	if err := svc.chanRepo.PublishChannelEvent(ctx, &ChannelEvent{
+		Type:      UserJoined,
+		ChannelID: channelID,
+		UserID:    userID,
+		Time:      time.Now().UnixMilli(),
+	}); err != nil {
+		// the user has joined, so a lost event must not fail the join
+		svc.logger.Error(fmt.Sprintf("error publish join of user %d to channel %d: %v", userID, channelID, err))
+	}
 	return nil
 }
 func (svc *UserServiceImpl) GetUser(ctx context.Context, userID uint64) (*User, error) {
@@ -215,33 +953,205 @@ func (svc *UserServiceImpl) GetOnlineUserIDs(ctx context.Context, channelID uint
 	return users, nil
 }
 
+// RemoveUserFromChannel removes the user from the members of the channel and returns the number of members left
+func (svc *UserServiceImpl) RemoveUserFromChannel(ctx context.Context, channelID, userID uint64) (int, error) {
+	if err := svc.userRepo.RemoveUserFromChannel(ctx, channelID, userID); err != nil {
+		return 0, fmt.Errorf("error remove user %d from channel %d: %w", userID, channelID, err)
+	}
+	if err := svc.DeleteOnlineUser(ctx, channelID, userID); err != nil {
+		return 0, err
+	}
+	memberIDs, err := svc.GetChannelMemberIDs(ctx, channelID)
+	if err != nil {
+		return 0, err
+	}
+	return len(memberIDs), nil
+}
+
+// GetChannelMemberLimit returns the maximum number of members of the channel.
+// Channels without their own limit use the configured maximum
+func (svc *UserServiceImpl) GetChannelMemberLimit(ctx context.Context, channelID uint64) (int, error) {
+	maxMembers, err := svc.userRepo.GetChannelMemberLimit(ctx, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("error get member limit of channel %d: %w", channelID, err)
+	}
+	if maxMembers == 0 {
+		return svc.maxMembers, nil
+	}
+	return maxMembers, nil
+}
+
+// SetChannelMemberLimit sets the maximum number of members of the channel, where 0 resets it to the configured maximum.
+// The limit cannot be lower than the number of current members
+func (svc *UserServiceImpl) SetChannelMemberLimit(ctx context.Context, channelID uint64, maxMembers int) error {
+	if maxMembers != 0 && (maxMembers < minMemberLimit || maxMembers > svc.maxMembers) {
+		return ErrInvalidMemberLimit
+	}
+	memberIDs, err := svc.GetChannelMemberIDs(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	if maxMembers != 0 && len(memberIDs) > maxMembers {
+		return ErrInvalidMemberLimit
+	}
+	if err := svc.userRepo.SetChannelMemberLimit(ctx, channelID, maxMembers); err != nil {
+		return fmt.Errorf("error set member limit of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+
+// GetChannelMemberIDs returns the users in the channel without the placeholder user inserted on channel creation
+func (svc *UserServiceImpl) GetChannelMemberIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
+	userIDs, err := svc.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	var memberIDs []uint64
+	for _, userID := range userIDs {
+		if userID != 0 {
+			memberIDs = append(memberIDs, userID)
+		}
+	}
+	return memberIDs, nil
+}
+
 type ChannelServiceImpl struct {
-	chanRepo ChannelRepoCache
-	userRepo UserRepoCache
-	sf       common.IDGenerator
+	logger     common.HttpLog
+	chanRepo   ChannelRepoCache
+	userRepo   UserRepoCache
+	msgIndexer MessageIndexer
+	sf         common.IDGenerator
 }
 
-func NewChannelServiceImpl(chanRepo ChannelRepoCache, userRepo UserRepoCache, sf common.IDGenerator) *ChannelServiceImpl {
-	return &ChannelServiceImpl{chanRepo, userRepo, sf}
+func NewChannelServiceImpl(logger common.HttpLog, chanRepo ChannelRepoCache, userRepo UserRepoCache, msgIndexer MessageIndexer, sf common.IDGenerator) *ChannelServiceImpl {
+	return &ChannelServiceImpl{logger, chanRepo, userRepo, msgIndexer, sf}
 }
-func (svc *ChannelServiceImpl) CreateChannel(ctx context.Context) (*Channel, error) {
+
+// CreateChannel creates a channel keeping its messages for the given retention and admitting at most the given members.
+// Zero keeps messages for the default retention, and admits up to the configured maximum of members
+func (svc *ChannelServiceImpl) CreateChannel(ctx context.Context, retentionSec int64, maxMembers int) (*Channel, error) {
+	if !isValidRetention(retentionSec) {
+		return nil, ErrInvalidRetention
+	}
+	if maxMembers != 0 && maxMembers < minMemberLimit {
+		return nil, ErrInvalidMemberLimit
+	}
 	channelID, err := svc.sf.NextID()
 	if err != nil {
 		return nil, fmt.Errorf("error create snowflake ID for new channel: %w", err)
 	}
-	channel, err := svc.chanRepo.CreateChannel(ctx, channelID)
+	channel, err := svc.chanRepo.CreateChannel(ctx, channelID, retentionSec, maxMembers)
 	if err != nil {
 		return nil, fmt.Errorf("error create channel %d: %w", channelID, err)
 	}
+	if err := svc.chanRepo.PublishChannelEvent(ctx, &ChannelEvent{
+		Type:      ChannelCreated,
+		ChannelID: channelID,
+		Time:      time.Now().UnixMilli(),
+	}); err != nil {
+		svc.logger.Error(fmt.Sprintf("error publish creation of channel %d: %v", channelID, err))
+	}
 	return channel, nil
 }
+
+// DeleteChannel revokes all access tokens of the channel before removing it,
+// so that the channel stops authorizing requests right away
 func (svc *ChannelServiceImpl) DeleteChannel(ctx context.Context, channelID uint64) error {
+	revocationTTL := time.Duration(common.JwtExpirationSecond+common.JwtRefreshGraceSecond) * time.Second
+	if err := svc.chanRepo.RevokeChannel(ctx, channelID, revocationTTL); err != nil {
+		return fmt.Errorf("error revoke tokens of channel %d: %w", channelID, err)
+	}
 	if err := svc.chanRepo.DeleteChannel(ctx, channelID); err != nil {
 		return fmt.Errorf("error delete channel %d: %w", channelID, err)
 	}
+	// the channel is gone at this point, so failures to clean up after it are logged rather than returned.
+	// Leftover index keys expire on their own
+	if err := svc.msgIndexer.RemoveChannel(ctx, channelID); err != nil {
+		svc.logger.Error(fmt.Sprintf("error remove index of channel %d: %v", channelID, err))
+	}
+	if err := svc.chanRepo.PublishChannelEvent(ctx, &ChannelEvent{
+		Type:      ChannelDeleted,
+		ChannelID: channelID,
+		Time:      time.Now().UnixMilli(),
+	}); err != nil {
+		svc.logger.Error(fmt.Sprintf("error publish deletion of channel %d: %v", channelID, err))
+	}
 	return nil
 }
 
+// RefreshChannelToken exchanges a valid or recently expired access token of a channel member for a new one.
+// Each token can be exchanged only once. Exchanging a token twice revokes its whole refresh chain,
+// since one of the holders must have stolen it
+func (svc *ChannelServiceImpl) RefreshChannelToken(ctx context.Context, accessToken string, userID uint64) (*Channel, error) {
+	claims, err := common.ParseRefreshableJWT(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	channelID := claims.ChannelID
+	channelRevoked, err := svc.IsChannelRevoked(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if channelRevoked {
+		return nil, common.ErrTokenRevoked
+	}
+	exist, err := svc.userRepo.IsChannelUserExist(ctx, channelID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error check user %d in channel %d: %w", userID, channelID, err)
+	}
+	if !exist {
+		return nil, ErrChannelOrUserNotFound
+	}
+	revoked, err := svc.chanRepo.IsTokenFamilyRevoked(ctx, claims.Family)
+	if err != nil {
+		return nil, fmt.Errorf("error check token family of channel %d: %w", channelID, err)
+	}
+	if revoked {
+		return nil, ErrTokenReused
+	}
+	grace := time.Duration(common.JwtRefreshGraceSecond) * time.Second
+	first, err := svc.chanRepo.MarkTokenRefreshed(ctx, claims.ID, time.Until(claims.ExpiresAt.Add(grace)))
+	if err != nil {
+		return nil, fmt.Errorf("error mark token refreshed in channel %d: %w", channelID, err)
+	}
+	if !first {
+		familyTTL := time.Duration(common.JwtExpirationSecond)*time.Second + grace
+		if err := svc.chanRepo.RevokeTokenFamily(ctx, claims.Family, familyTTL); err != nil {
+			return nil, fmt.Errorf("error revoke token family of channel %d: %w", channelID, err)
+		}
+		return nil, ErrTokenReused
+	}
+	newAccessToken, err := common.NewRefreshedJWT(channelID, claims.Family)
+	if err != nil {
+		return nil, fmt.Errorf("error create JWT: %w", err)
+	}
+	return &Channel{
+		ID:          channelID,
+		AccessToken: newAccessToken,
+	}, nil
+}
+func (svc *ChannelServiceImpl) IsChannelRevoked(ctx context.Context, channelID uint64) (bool, error) {
+	revoked, err := svc.chanRepo.IsChannelRevoked(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error check revocation of channel %d: %w", channelID, err)
+	}
+	return revoked, nil
+}
+
+// IsTokenRevoked reports whether an access token has been revoked, either because its channel is deleted
+// or because its refresh family is revoked after a token of the family was reused
+func (svc *ChannelServiceImpl) IsTokenRevoked(ctx context.Context, channelID uint64, family string) (bool, error) {
+	revoked, err := svc.IsChannelRevoked(ctx, channelID)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	revoked, err = svc.chanRepo.IsTokenFamilyRevoked(ctx, family)
+	if err != nil {
+		return false, fmt.Errorf("error check token family of channel %d: %w", channelID, err)
+	}
+	return revoked, nil
+}
+
 type ForwardServiceImpl struct {
 	forwardRepo ForwardRepo
 }
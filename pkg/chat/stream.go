@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+// StreamIdHeader carries the ID of the server-sent event connection that a frame sent over http belongs to
+const StreamIdHeader = "X-Stream-Id"
+
+// StreamHub holds the server-sent event connections of this instance, a fallback transport
+// for clients behind proxies that block websockets. It receives messages from the MessageSubscriber
+// along with the melody sessions
+type StreamHub struct {
+	mu         sync.RWMutex
+	conns      map[*streamConn]struct{}
+	ids        map[string]*streamConn
+	bufferSize int
+	keepalive  time.Duration
+}
+
+func NewStreamHub(config *config.Config) *StreamHub {
+	return &StreamHub{
+		conns:      make(map[*streamConn]struct{}),
+		ids:        make(map[string]*streamConn),
+		bufferSize: config.Chat.Stream.BufferSize,
+		keepalive:  time.Duration(config.Chat.Stream.KeepaliveSec) * time.Second,
+	}
+}
+
+// streamConn is a server-sent event connection. Live messages are queued until the handler writes them.
+// Frames sent over http name the connection by its random ID, which binds them to the connection user
+// and subjects them to the same throttling as the frames of a websocket session
+type streamConn struct {
+	id         string
+	channelID  uint64
+	userID     uint64
+	access     *sessionAccess
+	delivery   *sessionDelivery
+	typing     *typingThrottle
+	violations *violationTracker
+	send       chan *Message
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func (h *StreamHub) register(channelID, userID uint64, family string, lastMessageID uint64, typing *typingThrottle, violations *violationTracker) (*streamConn, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error generate stream id: %w", err)
+	}
+	conn := &streamConn{
+		id:         base64.RawURLEncoding.EncodeToString(b),
+		channelID:  channelID,
+		userID:     userID,
+		access:     newSessionAccess(family),
+		delivery:   newSessionDelivery(lastMessageID),
+		typing:     typing,
+		violations: violations,
+		send:       make(chan *Message, h.bufferSize),
+		closed:     make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.conns[conn] = struct{}{}
+	h.ids[conn.id] = conn
+	h.mu.Unlock()
+	return conn, nil
+}
+
+func (h *StreamHub) unregister(conn *streamConn) {
+	h.mu.Lock()
+	delete(h.conns, conn)
+	delete(h.ids, conn.id)
+	h.mu.Unlock()
+	conn.close()
+}
+
+// lookup returns the open connection of the ID on this instance, or nil if there is none
+func (h *StreamHub) lookup(id string) *streamConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ids[id]
+}
+
+// Broadcast queues the message to the connections of its channel. A connection whose queue is full
+// is closed rather than blocking delivery, and the client catches up by replay when it reconnects
+func (h *StreamHub) Broadcast(msg *Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for conn := range h.conns {
+		if conn.channelID != msg.ChannelID || !conn.delivery.accept(msg) {
+			continue
+		}
+		select {
+		case conn.send <- msg:
+		default:
+			conn.close()
+		}
+	}
+}
+
+// CloseChannel closes the connections of a deleted channel
+func (h *StreamHub) CloseChannel(channelID uint64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for conn := range h.conns {
+		if conn.channelID == channelID {
+			conn.close()
+		}
+	}
+}
+
+// CloseUser closes the connections of a user that left the channel
+func (h *StreamHub) CloseUser(channelID, userID uint64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for conn := range h.conns {
+		if conn.channelID == channelID && conn.userID == userID {
+			conn.close()
+		}
+	}
+}
+
+// Close closes all connections so that their handlers return on shutdown
+func (h *StreamHub) Close() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for conn := range h.conns {
+		conn.close()
+	}
+}
+
+func (conn *streamConn) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+}
+
+// writeStreamEvent writes the message as an event of JSON data. Text and file messages carry their ID
+// as the event ID, which the event source sends back as Last-Event-ID to resume from it
+func writeStreamEvent(w io.Writer, msg *Message) error {
+	data, err := jsonCodec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	if msg.Event == EventText || msg.Event == EventFile {
+		if _, err := fmt.Fprintf(w, "id: %d\n", msg.MessageID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// writeStreamOpen writes the stream event, which tells the client the ID of its connection
+func writeStreamOpen(w io.Writer, id string) error {
+	_, err := fmt.Fprintf(w, "event: stream\ndata: %s\n\n", id)
+	return err
+}
+
+// writeStreamKeepalive writes a comment that keeps idle connections from being cut by proxies
+func writeStreamKeepalive(w io.Writer) error {
+	_, err := io.WriteString(w, ": keepalive\n\n")
+	return err
+}
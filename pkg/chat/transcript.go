@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"time"
+)
+
+var transcriptHTMLHeader = template.Must(template.New("header").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Random Chat Transcript {{.ChannelID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 800px; margin: 0 auto; padding: 16px; color: #222; }
+.msg { padding: 8px 0; border-bottom: 1px solid #eee; }
+.meta { font-size: 0.8em; color: #888; }
+.name { font-weight: bold; }
+.deleted { font-style: italic; color: #aaa; }
+.text { white-space: pre-wrap; word-wrap: break-word; }
+</style>
+</head>
+<body>
+<h2>Channel {{.ChannelID}}</h2>
+<p class="meta">Exported at {{.ExportedAt}}</p>
+`))
+
+var transcriptHTMLMessage = template.Must(template.New("message").Parse(`<div class="msg" id="{{.MessageID}}">
+<div class="meta"><span class="name">{{if .UserName}}{{.UserName}}{{else}}{{.UserID}}{{end}}</span> {{.Time}}{{if .Edited}} (edited){{end}}{{if .ReplyTo}} replying to <a href="#{{.ReplyTo}}">message</a>{{end}}</div>
+{{if .Deleted}}<div class="deleted">message recalled</div>{{else if .Encrypted}}<div class="deleted">encrypted message</div>{{else if .FileName}}<div class="text">{{if .FileURL}}<a href="{{.FileURL}}">{{.FileName}}</a>{{else}}{{.FileName}}{{end}}</div>{{else}}<div class="text">{{.Payload}}</div>{{end}}
+</div>
+`))
+
+const transcriptHTMLFooter = `</body>
+</html>
+`
+
+// TranscriptWriter writes a channel transcript one message at a time
+type TranscriptWriter interface {
+	WriteHeader() error
+	WriteMessage(msg *TranscriptMessage) error
+	WriteFooter() error
+	ContentType() string
+	FileExt() string
+}
+
+func NewTranscriptWriter(format string, w io.Writer, channelID string) (TranscriptWriter, error) {
+	switch format {
+	case "", "json":
+		return &jsonTranscriptWriter{w: w, channelID: channelID}, nil
+	case "ndjson":
+		return &ndjsonTranscriptWriter{enc: json.NewEncoder(w)}, nil
+	case "html":
+		return &htmlTranscriptWriter{w: w, channelID: channelID}, nil
+	default:
+		return nil, ErrInvalidExportFormat
+	}
+}
+
+// jsonTranscriptWriter writes a single JSON document whose messages array is streamed element by element
+type jsonTranscriptWriter struct {
+	w         io.Writer
+	channelID string
+	count     int
+}
+
+func (t *jsonTranscriptWriter) WriteHeader() error {
+	header, _ := json.Marshal(t.channelID)
+	_, err := io.WriteString(t.w, `{"channel_id":`+string(header)+`,"messages":[`)
+	return err
+}
+func (t *jsonTranscriptWriter) WriteMessage(msg *TranscriptMessage) error {
+	data, err := json.Marshal(msg.ToPresenter())
+	if err != nil {
+		return err
+	}
+	if t.count > 0 {
+		if _, err := io.WriteString(t.w, ","); err != nil {
+			return err
+		}
+	}
+	t.count++
+	_, err = t.w.Write(data)
+	return err
+}
+func (t *jsonTranscriptWriter) WriteFooter() error {
+	_, err := io.WriteString(t.w, "]}\n")
+	return err
+}
+func (t *jsonTranscriptWriter) ContentType() string { return "application/json" }
+func (t *jsonTranscriptWriter) FileExt() string     { return "json" }
+
+type ndjsonTranscriptWriter struct {
+	enc *json.Encoder
+}
+
+func (t *ndjsonTranscriptWriter) WriteHeader() error { return nil }
+func (t *ndjsonTranscriptWriter) WriteMessage(msg *TranscriptMessage) error {
+	return t.enc.Encode(msg.ToPresenter())
+}
+func (t *ndjsonTranscriptWriter) WriteFooter() error  { return nil }
+func (t *ndjsonTranscriptWriter) ContentType() string { return "application/x-ndjson" }
+func (t *ndjsonTranscriptWriter) FileExt() string     { return "ndjson" }
+
+type htmlTranscriptWriter struct {
+	w         io.Writer
+	channelID string
+}
+
+func (t *htmlTranscriptWriter) WriteHeader() error {
+	return transcriptHTMLHeader.Execute(t.w, map[string]string{
+		"ChannelID":  t.channelID,
+		"ExportedAt": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+func (t *htmlTranscriptWriter) WriteMessage(msg *TranscriptMessage) error {
+	presenter := msg.ToPresenter()
+	return transcriptHTMLMessage.Execute(t.w, map[string]interface{}{
+		"MessageID": presenter.MessageID,
+		"UserID":    presenter.UserID,
+		"UserName":  presenter.UserName,
+		"Time":      time.UnixMilli(msg.Time).UTC().Format("2006/01/02 15:04:05 MST"),
+		"Edited":    msg.EditedAt != 0,
+		"ReplyTo":   presenter.ReplyTo,
+		"Deleted":   presenter.Deleted,
+		"Encrypted": presenter.Encrypted,
+		"FileName":  presenter.FileName,
+		"FileURL":   presenter.FileURL,
+		"Payload":   presenter.Payload,
+	})
+}
+func (t *htmlTranscriptWriter) WriteFooter() error {
+	_, err := io.WriteString(t.w, transcriptHTMLFooter)
+	return err
+}
+func (t *htmlTranscriptWriter) ContentType() string { return "text/html; charset=utf-8" }
+func (t *htmlTranscriptWriter) FileExt() string     { return "html" }
@@ -1,7 +1,15 @@
 package chat
 
 import (
+	b64 "encoding/base64"
 	"encoding/json"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
+
+const (
+	maxQuotePayloadRunes = 64
+	presignedDownloadURL = "/api/uploader/download/presigned?okb64="
 )
 
 func DecodeToMessagePresenter(data []byte) (*MessagePresenter, error) {
@@ -12,6 +20,30 @@ func DecodeToMessagePresenter(data []byte) (*MessagePresenter, error) {
 	return &msg, nil
 }
 
+func DecodeToReaction(data []byte) (*Reaction, error) {
+	var reaction Reaction
+	if err := json.Unmarshal(data, &reaction); err != nil {
+		return nil, err
+	}
+	return &reaction, nil
+}
+
+func DecodeToPublicKey(data []byte) (*PublicKey, error) {
+	var key PublicKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func DecodeToChannelEvent(data []byte) (*ChannelEvent, error) {
+	var event ChannelEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
 func DecodeToMessage(data []byte) (*Message, error) {
 	var msg Message
 	if err := json.Unmarshal(data, &msg); err != nil {
@@ -19,3 +51,28 @@ func DecodeToMessage(data []byte) (*Message, error) {
 	}
 	return &msg, nil
 }
+
+// isValidRetention accepts zero, which stands for the default retention, or a retention within bounds
+func isValidRetention(retentionSec int64) bool {
+	return retentionSec == 0 || (retentionSec >= minRetentionSec && retentionSec <= maxRetentionSec)
+}
+
+func truncate(s string, maxRunes int) string {
+	runes := []rune(s)
+	if len(runes) <= maxRunes {
+		return s
+	}
+	return string(runes[:maxRunes]) + "..."
+}
+
+// getFileLink returns the stored file url, or the uploader endpoint that presigns a download url
+// for the object key if the file is uploaded with a presigned url
+func getFileLink(file *FilePayload) string {
+	if file.FileURL != "" {
+		return file.FileURL
+	}
+	if file.ObjectKey == "" {
+		return ""
+	}
+	return common.Join(presignedDownloadURL, b64.URLEncoding.EncodeToString([]byte(file.ObjectKey)))
+}
@@ -73,7 +73,13 @@ func LimitBodySize(maxBodyBytes int64) gin.HandlerFunc {
 	}
 }
 
-func JWTAuth() gin.HandlerFunc {
+// TokenRevocationStore tells whether an access token has been revoked, either along with its channel
+// or along with its refresh family
+type TokenRevocationStore interface {
+	IsTokenRevoked(ctx context.Context, channelID uint64, family string) (bool, error)
+}
+
+func JWTAuth(store TokenRevocationStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		accessToken := extractTokenFromHeader(c.Request)
 		if accessToken == "" {
@@ -93,6 +99,19 @@ func JWTAuth() gin.HandlerFunc {
 			})
 			return
 		}
+		revoked, err := store.IsTokenRevoked(c.Request.Context(), authResult.ChannelID, authResult.Family)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrResponse{
+				Message: ErrServer.Error(),
+			})
+			return
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrResponse{
+				Message: ErrTokenRevoked.Error(),
+			})
+			return
+		}
 		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), ChannelKey, authResult.ChannelID))
 		c.Next()
 	}
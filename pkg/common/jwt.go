@@ -1,25 +1,32 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
 var (
-	JwtSecret           string
-	JwtExpirationSecond int64
+	JwtSecret             string
+	JwtExpirationSecond   int64
+	JwtRefreshGraceSecond int64
 )
 
 var (
 	ErrInvalidToken = errors.New("invalid token")
 	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
 )
 
 type JWTClaims struct {
 	ChannelID uint64
+	// Family is the ID of the first token of a refresh chain
+	Family string `json:"fam,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -29,6 +36,7 @@ type AuthPayload struct {
 
 type AuthResponse struct {
 	ChannelID uint64
+	Family    string
 	Expired   bool
 }
 
@@ -49,17 +57,31 @@ func Auth(authPayload *AuthPayload) (*AuthResponse, error) {
 		return nil, ErrInvalidToken
 	}
 
+	fillTokenIdentity(authPayload.AccessToken, claims)
 	return &AuthResponse{
 		ChannelID: claims.ChannelID,
+		Family:    claims.Family,
 		Expired:   false,
 	}, nil
 }
 
 func NewJWT(channelID uint64) (string, error) {
+	return NewRefreshedJWT(channelID, "")
+}
+
+// NewRefreshedJWT creates a token that continues the refresh chain of the family.
+// An empty family starts a new chain
+func NewRefreshedJWT(channelID uint64, family string) (string, error) {
+	tokenID := uuid.New().String()
+	if family == "" {
+		family = tokenID
+	}
 	expiresAt := time.Now().Add(time.Duration(JwtExpirationSecond) * time.Second)
 	jwtClaims := &JWTClaims{
 		ChannelID: channelID,
+		Family:    family,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 		},
 	}
@@ -71,11 +93,40 @@ func NewJWT(channelID uint64) (string, error) {
 	return accessToken, nil
 }
 
-func parseToken(accessToken string) (*jwt.Token, error) {
+// ParseRefreshableJWT returns the claims of a token that is still valid or expired within the refresh grace window
+func ParseRefreshableJWT(accessToken string) (*JWTClaims, error) {
+	token, err := parseToken(accessToken, jwt.WithoutClaimsValidation())
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(*JWTClaims)
+	if !(ok && token.Valid) || claims.ExpiresAt == nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().After(claims.ExpiresAt.Add(time.Duration(JwtRefreshGraceSecond) * time.Second)) {
+		return nil, ErrTokenExpired
+	}
+	fillTokenIdentity(accessToken, claims)
+	return claims, nil
+}
+
+// fillTokenIdentity sets the ID and family of a token issued before refresh chains were introduced,
+// which is identified by its digest and forms a family of its own
+func fillTokenIdentity(accessToken string, claims *JWTClaims) {
+	if claims.ID == "" {
+		digest := sha256.Sum256([]byte(accessToken))
+		claims.ID = hex.EncodeToString(digest[:])
+	}
+	if claims.Family == "" {
+		claims.Family = claims.ID
+	}
+}
+
+func parseToken(accessToken string, options ...jwt.ParserOption) (*jwt.Token, error) {
 	return jwt.ParseWithClaims(accessToken, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(JwtSecret), nil
-	})
+	}, options...)
 }
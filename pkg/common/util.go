@@ -3,10 +3,14 @@ package common
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/sony/sonyflake"
 )
 
+// sonyflakeStartTime is the default epoch used by sonyflake when no start time is set
+var sonyflakeStartTime = time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)
+
 // IDGenerator is the inteface for generatring unique ID
 type IDGenerator interface {
 	NextID() (uint64, error)
@@ -21,6 +25,15 @@ func NewSonyFlake() (IDGenerator, error) {
 	return sf, nil
 }
 
+// SonyFlakeLowerBoundID returns the smallest sonyflake ID that could be generated at time t
+func SonyFlakeLowerBoundID(t time.Time) uint64 {
+	if t.Before(sonyflakeStartTime) {
+		return 0
+	}
+	elapsed := t.Sub(sonyflakeStartTime) / (10 * time.Millisecond)
+	return uint64(elapsed) << (sonyflake.BitLenSequence + sonyflake.BitLenMachineID)
+}
+
 func GetServerAddrs(addrs string) []string {
 	return strings.Split(addrs, ",")
 }
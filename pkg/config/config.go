@@ -13,6 +13,7 @@ type Config struct {
 	Match         *MatchConfig         `mapstructure:"match"`
 	Uploader      *UploaderConfig      `mapstructure:"uploader"`
 	User          *UserConfig          `mapstructure:"user"`
+	Webhook       *WebhookConfig       `mapstructure:"webhook"`
 	Kafka         *KafkaConfig         `mapstructure:"kafka"`
 	Cassandra     *CassandraConfig     `mapstructure:"cassandra"`
 	Redis         *RedisConfig         `mapstructure:"redis"`
@@ -52,13 +53,53 @@ type ChatConfig struct {
 		Id string
 	}
 	Message struct {
-		MaxNum        int64
-		PaginationNum int
-		MaxSizeByte   int64
+		MaxNum               int64
+		PaginationNum        int
+		MaxSizeByte          int64
+		MaxReplayNum         int
+		TypingThrottleMs     int64
+		RetentionSec         int64
+		ExpireIntervalMs     int64
+		IdempotencyWindowSec int64
+	}
+	Channel struct {
+		MaxMembers int
+	}
+	Search struct {
+		IndexTTLHour int64
+	}
+	Stream struct {
+		KeepaliveSec int64
+		BufferSize   int
+	}
+	RateLimit struct {
+		Text               EventRateLimitConfig
+		Action             EventRateLimitConfig
+		Seen               EventRateLimitConfig
+		File               EventRateLimitConfig
+		Edit               EventRateLimitConfig
+		Delete             EventRateLimitConfig
+		Reaction           EventRateLimitConfig
+		Pin                EventRateLimitConfig
+		KeyExchange        EventRateLimitConfig
+		MaxViolations      int
+		ViolationWindowSec int64
+	}
+	Moderation struct {
+		WordList         string
+		WordListReject   bool
+		MaxLinks         int
+		MaxRepeatedChars int
+		BlockedDomains   string
+		Classifier       struct {
+			Url       string
+			TimeoutMs int64
+		}
 	}
 	JWT struct {
-		Secret           string
-		ExpirationSecond int64
+		Secret             string
+		ExpirationSecond   int64
+		RefreshGraceSecond int64
 	}
 }
 
@@ -95,6 +136,11 @@ type RateLimitConfig struct {
 	Burst int
 }
 
+type EventRateLimitConfig struct {
+	User    RateLimitConfig
+	Channel RateLimitConfig
+}
+
 type UploaderConfig struct {
 	Http struct {
 		Server struct {
@@ -149,6 +195,29 @@ type UserConfig struct {
 	}
 }
 
+type WebhookConfig struct {
+	Http struct {
+		Server struct {
+			Port    string
+			MaxConn int64
+			ApiKey  string
+		}
+	}
+	Subscriber struct {
+		Group string
+	}
+	Delivery struct {
+		TimeoutMs     int64
+		MaxAttempts   int
+		BackoffBaseMs int64
+		BackoffMaxMs  int64
+		IntervalMs    int64
+		LeaseMs       int64
+		// AllowPrivateNetworks lets webhooks reach loopback, private and link-local addresses
+		AllowPrivateNetworks bool
+	}
+}
+
 type KafkaConfig struct {
 	Addrs   string
 	Version string
@@ -194,8 +263,63 @@ func setDefault() {
 	viper.SetDefault("chat.message.maxNum", 5000)
 	viper.SetDefault("chat.message.paginationNum", 5000)
 	viper.SetDefault("chat.message.maxSizeByte", 4096)
+	viper.SetDefault("chat.message.maxReplayNum", 100)
+	viper.SetDefault("chat.message.typingThrottleMs", 1000)
+	viper.SetDefault("chat.message.retentionSec", 0)
+	viper.SetDefault("chat.message.expireIntervalMs", 1000)
+	viper.SetDefault("chat.message.idempotencyWindowSec", 3600)
+	viper.SetDefault("chat.channel.maxMembers", 50)
+	viper.SetDefault("chat.search.indexTTLHour", 720)
+	viper.SetDefault("chat.stream.keepaliveSec", 15)
+	viper.SetDefault("chat.stream.bufferSize", 256)
+	viper.SetDefault("chat.rateLimit.text.user.rps", 5)
+	viper.SetDefault("chat.rateLimit.text.user.burst", 10)
+	viper.SetDefault("chat.rateLimit.text.channel.rps", 50)
+	viper.SetDefault("chat.rateLimit.text.channel.burst", 100)
+	viper.SetDefault("chat.rateLimit.action.user.rps", 10)
+	viper.SetDefault("chat.rateLimit.action.user.burst", 20)
+	viper.SetDefault("chat.rateLimit.action.channel.rps", 100)
+	viper.SetDefault("chat.rateLimit.action.channel.burst", 200)
+	viper.SetDefault("chat.rateLimit.seen.user.rps", 10)
+	viper.SetDefault("chat.rateLimit.seen.user.burst", 20)
+	viper.SetDefault("chat.rateLimit.seen.channel.rps", 100)
+	viper.SetDefault("chat.rateLimit.seen.channel.burst", 200)
+	viper.SetDefault("chat.rateLimit.file.user.rps", 1)
+	viper.SetDefault("chat.rateLimit.file.user.burst", 5)
+	viper.SetDefault("chat.rateLimit.file.channel.rps", 10)
+	viper.SetDefault("chat.rateLimit.file.channel.burst", 20)
+	viper.SetDefault("chat.rateLimit.edit.user.rps", 2)
+	viper.SetDefault("chat.rateLimit.edit.user.burst", 5)
+	viper.SetDefault("chat.rateLimit.edit.channel.rps", 20)
+	viper.SetDefault("chat.rateLimit.edit.channel.burst", 50)
+	viper.SetDefault("chat.rateLimit.delete.user.rps", 2)
+	viper.SetDefault("chat.rateLimit.delete.user.burst", 5)
+	viper.SetDefault("chat.rateLimit.delete.channel.rps", 20)
+	viper.SetDefault("chat.rateLimit.delete.channel.burst", 50)
+	viper.SetDefault("chat.rateLimit.reaction.user.rps", 5)
+	viper.SetDefault("chat.rateLimit.reaction.user.burst", 10)
+	viper.SetDefault("chat.rateLimit.reaction.channel.rps", 50)
+	viper.SetDefault("chat.rateLimit.reaction.channel.burst", 100)
+	viper.SetDefault("chat.rateLimit.pin.user.rps", 1)
+	viper.SetDefault("chat.rateLimit.pin.user.burst", 5)
+	viper.SetDefault("chat.rateLimit.pin.channel.rps", 10)
+	viper.SetDefault("chat.rateLimit.pin.channel.burst", 20)
+	viper.SetDefault("chat.rateLimit.keyExchange.user.rps", 1)
+	viper.SetDefault("chat.rateLimit.keyExchange.user.burst", 3)
+	viper.SetDefault("chat.rateLimit.keyExchange.channel.rps", 10)
+	viper.SetDefault("chat.rateLimit.keyExchange.channel.burst", 20)
+	viper.SetDefault("chat.rateLimit.maxViolations", 20)
+	viper.SetDefault("chat.rateLimit.violationWindowSec", 10)
+	viper.SetDefault("chat.moderation.wordList", "")
+	viper.SetDefault("chat.moderation.wordListReject", false)
+	viper.SetDefault("chat.moderation.maxLinks", 3)
+	viper.SetDefault("chat.moderation.maxRepeatedChars", 30)
+	viper.SetDefault("chat.moderation.blockedDomains", "")
+	viper.SetDefault("chat.moderation.classifier.url", "")
+	viper.SetDefault("chat.moderation.classifier.timeoutMs", 500)
 	viper.SetDefault("chat.jwt.secret", "replaceme")
 	viper.SetDefault("chat.jwt.expirationSecond", 86400)
+	viper.SetDefault("chat.jwt.refreshGraceSecond", 3600)
 
 	viper.SetDefault("match.http.server.port", "5002")
 	viper.SetDefault("match.http.server.maxConn", 200)
@@ -232,6 +356,18 @@ func setDefault() {
 
 	viper.SetDefault("forwarder.grpc.server.port", "4002")
 
+	viper.SetDefault("webhook.http.server.port", "5005")
+	viper.SetDefault("webhook.http.server.maxConn", 200)
+	viper.SetDefault("webhook.http.server.apiKey", "")
+	viper.SetDefault("webhook.subscriber.group", "rc.webhook")
+	viper.SetDefault("webhook.delivery.timeoutMs", 5000)
+	viper.SetDefault("webhook.delivery.maxAttempts", 8)
+	viper.SetDefault("webhook.delivery.backoffBaseMs", 1000)
+	viper.SetDefault("webhook.delivery.backoffMaxMs", 600000)
+	viper.SetDefault("webhook.delivery.intervalMs", 500)
+	viper.SetDefault("webhook.delivery.leaseMs", 60000)
+	viper.SetDefault("webhook.delivery.allowPrivateNetworks", false)
+
 	viper.SetDefault("kafka.addrs", "localhost:9092")
 	viper.SetDefault("kafka.version", "1.0.0")
 
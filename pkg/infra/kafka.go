@@ -36,7 +36,14 @@ func NewKafkaPublisher(config *config.Config) (message.Publisher, error) {
 	return kafkaPublisher, nil
 }
 
+// NewKafkaSubscriber creates a subscriber in its own consumer group, so that it receives every message
 func NewKafkaSubscriber(config *config.Config) (message.Subscriber, error) {
+	return NewKafkaGroupSubscriber(config, watermill.NewUUID())
+}
+
+// NewKafkaGroupSubscriber creates a subscriber in the consumer group, which shares messages
+// among the subscribers of the group
+func NewKafkaGroupSubscriber(config *config.Config, consumerGroup string) (message.Subscriber, error) {
 	saramaConfig := sarama.NewConfig()
 	saramaVersion, err := sarama.ParseKafkaVersion(config.Kafka.Version)
 	if err != nil {
@@ -51,7 +58,7 @@ func NewKafkaSubscriber(config *config.Config) (message.Subscriber, error) {
 		kafka.SubscriberConfig{
 			Brokers:       common.GetServerAddrs(config.Kafka.Addrs),
 			Unmarshaler:   kafka.DefaultMarshaler{},
-			ConsumerGroup: watermill.NewUUID(),
+			ConsumerGroup: consumerGroup,
 			InitializeTopicDetails: &sarama.TopicDetail{
 				NumPartitions:     1,
 				ReplicationFactor: 2,
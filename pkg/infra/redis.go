@@ -26,7 +26,9 @@ var (
 type RedisCache interface {
 	Get(ctx context.Context, key string, dst interface{}) (bool, error)
 	Set(ctx context.Context, key string, val interface{}) error
+	SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error)
 	Delete(ctx context.Context, key string) error
+	Expire(ctx context.Context, key string, ttl time.Duration) error
 	HGet(ctx context.Context, key, field string, dst interface{}) (bool, error)
 	HMGet(ctx context.Context, key string, fields []string) ([]interface{}, error)
 	HGetAll(ctx context.Context, key string) (map[string]string, error)
@@ -35,9 +37,14 @@ type RedisCache interface {
 	RPush(ctx context.Context, key string, val interface{}) error
 	LRange(ctx context.Context, key string, start, stop int64) ([]string, error)
 	Publish(ctx context.Context, topic string, payload interface{}) error
+	Subscribe(ctx context.Context, topic string, handler func(payload string)) error
 	ZPopMinOrAddOne(ctx context.Context, key string, score float64, member interface{}) (bool, string, error)
 	ZRemOne(ctx context.Context, key string, member interface{}) error
+	ZAddOne(ctx context.Context, key string, score float64, member interface{}) error
+	ZRangeWithScores(ctx context.Context, key string, start, stop int64) (map[string]float64, error)
+	ZLeaseByScore(ctx context.Context, key string, max float64, leaseUntil float64, count int64) ([]string, error)
 	HGetIfKeyExists(ctx context.Context, key, field string, dst interface{}) (bool, bool, error)
+	HSetNXIfKeyExistsWithLimit(ctx context.Context, key, field string, val interface{}, limit int64) (bool, bool, error)
 	ExecPipeLine(ctx context.Context, cmds *[]RedisCmd) error
 }
 
@@ -149,6 +156,11 @@ func (rc *RedisCacheImpl) Set(ctx context.Context, key string, val interface{})
 	return nil
 }
 
+// SetNX sets a key-value pair with the given TTL only if the key does not exist, and reports whether it was set
+func (rc *RedisCacheImpl) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	return rc.client.SetNX(ctx, key, val, ttl).Result()
+}
+
 // Delete deletes a key
 func (rc *RedisCacheImpl) Delete(ctx context.Context, key string) error {
 	if err := rc.client.Del(ctx, key).Err(); err != nil {
@@ -157,6 +169,11 @@ func (rc *RedisCacheImpl) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// Expire sets the TTL of a key
+func (rc *RedisCacheImpl) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return rc.client.Expire(ctx, key, ttl).Err()
+}
+
 func (rc *RedisCacheImpl) HGet(ctx context.Context, key, field string, dst interface{}) (bool, error) {
 	val, err := rc.client.HGet(ctx, key, field).Result()
 	if err == redis.Nil {
@@ -199,6 +216,28 @@ func (rc *RedisCacheImpl) Publish(ctx context.Context, topic string, payload int
 	return rc.client.Publish(ctx, topic, payload).Err()
 }
 
+// Subscribe calls handler on every message published to the topic until ctx is done.
+// Redis pub/sub is at-most-once, so messages published while disconnected are lost
+func (rc *RedisCacheImpl) Subscribe(ctx context.Context, topic string, handler func(payload string)) error {
+	pubsub := rc.client.Subscribe(ctx, topic)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			handler(msg.Payload)
+		}
+	}
+}
+
 var zPopMinOrAddOne = redis.NewScript(`
 local key = KEYS[1]
 local score = ARGV[1]
@@ -229,6 +268,68 @@ func (rc *RedisCacheImpl) ZPopMinOrAddOne(ctx context.Context, key string, score
 func (rc *RedisCacheImpl) ZRemOne(ctx context.Context, key string, member interface{}) error {
 	return rc.client.ZRem(ctx, key, member).Err()
 }
+func (rc *RedisCacheImpl) ZAddOne(ctx context.Context, key string, score float64, member interface{}) error {
+	return rc.client.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
+}
+func (rc *RedisCacheImpl) ZRangeWithScores(ctx context.Context, key string, start, stop int64) (map[string]float64, error) {
+	zs, err := rc.client.ZRangeWithScores(ctx, key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]float64, len(zs))
+	for _, z := range zs {
+		scores[z.Member.(string)] = z.Score
+	}
+	return scores, nil
+}
+
+var zLeaseByScore = redis.NewScript(`
+local key = KEYS[1]
+local max = ARGV[1]
+local leaseUntil = ARGV[2]
+local count = ARGV[3]
+
+local members = redis.call("ZRANGEBYSCORE", key, "-inf", max, "LIMIT", 0, count)
+for _, member in ipairs(members) do
+  redis.call("ZADD", key, leaseUntil, member)
+end
+return members
+`)
+
+// ZLeaseByScore atomically returns at most count members with scores no greater than max and
+// rescores them to leaseUntil, so that they are handed out again unless removed before then
+func (rc *RedisCacheImpl) ZLeaseByScore(ctx context.Context, key string, max float64, leaseUntil float64, count int64) ([]string, error) {
+	return zLeaseByScore.Run(ctx, rc.client, []string{key}, max, leaseUntil, count).StringSlice()
+}
+
+var hsetNXIfKeyExistsWithLimit = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+local val = ARGV[2]
+local limit = tonumber(ARGV[3])
+
+if redis.call("EXISTS", key) == 0 then
+  return -1
+end
+if redis.call("HEXISTS", key, field) == 1 then
+  return 1
+end
+if redis.call("HLEN", key) >= limit then
+  return 0
+end
+redis.call("HSET", key, field, val)
+return 1
+`)
+
+// HSetNXIfKeyExistsWithLimit sets the field of an existing hash unless the hash already has limit fields.
+// It returns whether the hash exists and whether the field is set, which includes a field set before
+func (rc *RedisCacheImpl) HSetNXIfKeyExistsWithLimit(ctx context.Context, key, field string, val interface{}, limit int64) (bool, bool, error) {
+	result, err := hsetNXIfKeyExistsWithLimit.Run(ctx, rc.client, []string{key}, field, val, limit).Int()
+	if err != nil {
+		return false, false, err
+	}
+	return result != -1, result == 1, nil
+}
 
 var hgetIfKeyExists = redis.NewScript(`
 local key = KEYS[1]
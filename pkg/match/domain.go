@@ -2,6 +2,7 @@ package match
 
 import (
 	"encoding/json"
+	"strconv"
 )
 
 type User struct {
@@ -26,3 +27,15 @@ func (r *MatchResult) ToPresenter() *MatchResultPresenter {
 		AccessToken: r.AccessToken,
 	}
 }
+
+type Room struct {
+	ChannelID   uint64
+	AccessToken string
+}
+
+func (r *Room) ToPresenter() *RoomPresenter {
+	return &RoomPresenter{
+		ChannelID:   strconv.FormatUint(r.ChannelID, 10),
+		AccessToken: r.AccessToken,
+	}
+}
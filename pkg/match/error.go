@@ -4,4 +4,6 @@ import "errors"
 
 var (
 	ErrUserNotFound = errors.New("error user not found")
+	// ErrInvalidChannel is returned when the chat service rejects the settings of a new channel
+	ErrInvalidChannel = errors.New("error invalid channel")
 )
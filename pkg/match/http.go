@@ -39,6 +39,7 @@ type HttpServer struct {
 	matchSubscriber *MatchSubscriber
 	userSvc         UserService
 	matchSvc        MatchingService
+	roomSvc         RoomService
 	serveSwag       bool
 }
 
@@ -65,7 +66,7 @@ func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gi
 	return svr
 }
 
-func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mm MelodyMatchConn, matchSubscriber *MatchSubscriber, userSvc UserService, matchSvc MatchingService) *HttpServer {
+func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mm MelodyMatchConn, matchSubscriber *MatchSubscriber, userSvc UserService, matchSvc MatchingService, roomSvc RoomService) *HttpServer {
 	return &HttpServer{
 		name:            name,
 		logger:          logger,
@@ -75,6 +76,7 @@ func NewHttpServer(name string, logger common.HttpLog, config *config.Config, sv
 		matchSubscriber: matchSubscriber,
 		userSvc:         userSvc,
 		matchSvc:        matchSvc,
+		roomSvc:         roomSvc,
 		serveSwag:       config.Match.Http.Server.Swag,
 	}
 }
@@ -112,6 +114,7 @@ func (r *HttpServer) RegisterRoutes() {
 		cookieAuthGroup := matchGroup.Group("")
 		cookieAuthGroup.Use(r.CookieAuth())
 		cookieAuthGroup.GET("", r.Match)
+		cookieAuthGroup.POST("/room", r.CreateRoom)
 	}
 
 	r.mm.HandleConnect(r.HandleMatchOnConnect)
@@ -11,7 +11,7 @@ import (
 )
 
 // @Summary Match another user
-// @Description Websocket initialization endpoint for matching another user
+// @Description Websocket initialization endpoint for matching another user. A matched channel is created with the default message retention, which its members can change with PUT /chat/channel/retention
 // @Tags match
 // @Produce json
 // @Param Cookie header string true "session id cookie"
@@ -42,6 +42,55 @@ func (r *HttpServer) Match(c *gin.Context) {
 	}
 }
 
+// @Summary Create a room
+// @Description Create a group channel with the current user as its first member. Other users join the room by invitation of its members. Messages of the room are kept for retention_sec seconds, between 10 seconds and a year, or for the default retention if it is zero or the body is empty
+// @Tags match
+// @Accept json
+// @Produce json
+// @Param Cookie header string true "session id cookie"
+// @Param room body CreateRoomPresenter false "room"
+// @Success 201 {object} RoomPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /match/room [post]
+func (r *HttpServer) CreateRoom(c *gin.Context) {
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var req CreateRoomPresenter
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	_, err := r.userSvc.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			response(c, http.StatusNotFound, ErrUserNotFound)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	room, err := r.roomSvc.CreateRoom(c.Request.Context(), userID, req.RetentionSec)
+	if err != nil {
+		if errors.Is(err, ErrInvalidChannel) {
+			response(c, http.StatusBadRequest, err)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusCreated, room.ToPresenter())
+}
+
 func (r *HttpServer) HandleMatchOnConnect(sess *melody.Session) {
 	userID, ok := sess.Request.Context().Value(common.UserKey).(uint64)
 	if !ok {
@@ -8,6 +8,15 @@ type MatchResultPresenter struct {
 	AccessToken string `json:"access_token"`
 }
 
+type CreateRoomPresenter struct {
+	RetentionSec int64 `json:"retention_sec" binding:"gte=0"`
+}
+
+type RoomPresenter struct {
+	ChannelID   string `json:"channel_id"`
+	AccessToken string `json:"access_token"`
+}
+
 func (m *MatchResultPresenter) Encode() []byte {
 	result, _ := json.Marshal(m)
 	return result
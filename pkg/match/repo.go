@@ -2,6 +2,7 @@ package match
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/minghsu0107/go-random-chat/pkg/transport"
 	chatpb "github.com/minghsu0107/go-random-chat/proto/chat"
 	userpb "github.com/minghsu0107/go-random-chat/proto/user"
+	"google.golang.org/grpc/codes"
 )
 
 var (
@@ -20,7 +22,7 @@ var (
 )
 
 type ChannelRepo interface {
-	CreateChannel(ctx context.Context) (uint64, string, error)
+	CreateChannel(ctx context.Context, retentionSec int64, maxMembers int) (uint64, string, error)
 }
 
 type UserRepo interface {
@@ -51,9 +53,15 @@ func NewChannelRepoImpl(chatConn *ChatClientConn) *ChannelRepoImpl {
 	}
 }
 
-func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context) (uint64, string, error) {
-	res, err := repo.createChannel(ctx, &chatpb.CreateChannelRequest{})
+func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, retentionSec int64, maxMembers int) (uint64, string, error) {
+	res, err := repo.createChannel(ctx, &chatpb.CreateChannelRequest{
+		RetentionSec: retentionSec,
+		MaxMembers:   int32(maxMembers),
+	})
 	if err != nil {
+		if st := transport.GrpcStatus(err); st.Code() == codes.InvalidArgument {
+			return 0, "", fmt.Errorf("%w: %s", ErrInvalidChannel, st.Message())
+		}
 		return 0, "", err
 	}
 	return res.(*chatpb.CreateChannelResponse).ChannelId, res.(*chatpb.CreateChannelResponse).AccessToken, nil
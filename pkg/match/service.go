@@ -2,9 +2,13 @@ package match
 
 import (
 	"context"
+	"errors"
 	"fmt"
 )
 
+// matchMemberLimit is the member limit of a channel of matched users
+const matchMemberLimit = 2
+
 type UserService interface {
 	GetUserByID(ctx context.Context, uid uint64) (*User, error)
 	GetUserIDBySession(ctx context.Context, sid string) (uint64, error)
@@ -17,6 +21,10 @@ type MatchingService interface {
 	RemoveUserFromWaitList(ctx context.Context, userID uint64) error
 }
 
+type RoomService interface {
+	CreateRoom(ctx context.Context, userID uint64, retentionSec int64) (*Room, error)
+}
+
 type UserServiceImpl struct {
 	userRepo UserRepo
 }
@@ -62,7 +70,8 @@ func (svc *MatchingServiceImpl) Match(ctx context.Context, userID uint64) (*Matc
 		return nil, fmt.Errorf("error match user %d: %w", userID, err)
 	}
 	if matched {
-		newChannelID, accessToken, err := svc.chanRepo.CreateChannel(ctx)
+		// a random chat is between the matched pair only, so no one else can be invited
+		newChannelID, accessToken, err := svc.chanRepo.CreateChannel(ctx, 0, matchMemberLimit)
 		if err != nil {
 			return nil, fmt.Errorf("error create channel: %w", err)
 		}
@@ -90,3 +99,32 @@ func (svc *MatchingServiceImpl) RemoveUserFromWaitList(ctx context.Context, user
 	}
 	return nil
 }
+
+type RoomServiceImpl struct {
+	chanRepo ChannelRepo
+	userRepo UserRepo
+}
+
+func NewRoomServiceImpl(chanRepo ChannelRepo, userRepo UserRepo) *RoomServiceImpl {
+	return &RoomServiceImpl{chanRepo, userRepo}
+}
+
+// CreateRoom creates a group channel with the user as its first member.
+// Messages of the room are kept for the given retention, or the default retention if it is zero.
+// The retention is validated by the chat service, whose reason is returned wrapped in ErrInvalidChannel
+func (svc *RoomServiceImpl) CreateRoom(ctx context.Context, userID uint64, retentionSec int64) (*Room, error) {
+	channelID, accessToken, err := svc.chanRepo.CreateChannel(ctx, retentionSec, 0)
+	if err != nil {
+		if errors.Is(err, ErrInvalidChannel) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error create channel: %w", err)
+	}
+	if err := svc.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
+		return nil, fmt.Errorf("error add user %d to channel %d: %w", userID, channelID, err)
+	}
+	return &Room{
+		ChannelID:   channelID,
+		AccessToken: accessToken,
+	}, nil
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"runtime/debug"
@@ -207,6 +208,16 @@ func NewGrpcEndpoint(conn *grpc.ClientConn, serviceID, serviceName, method strin
 	return ep
 }
 
+// GrpcStatus returns the gRPC status of an error returned by an endpoint created with NewGrpcEndpoint,
+// whose retries wrap the error of the final attempt
+func GrpcStatus(err error) *status.Status {
+	var retryErr lb.RetryError
+	if errors.As(err, &retryErr) {
+		err = retryErr.Final
+	}
+	return status.Convert(err)
+}
+
 func encodeGRPCRequest(_ context.Context, request interface{}) (interface{}, error) {
 	return request, nil
 }
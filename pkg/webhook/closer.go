@@ -0,0 +1,16 @@
+package webhook
+
+import (
+	"github.com/minghsu0107/go-random-chat/pkg/infra"
+)
+
+type InfraCloser struct{}
+
+func NewInfraCloser() *InfraCloser {
+	return &InfraCloser{}
+}
+
+func (closer *InfraCloser) Close() error {
+	infra.CassandraSession.Close()
+	return infra.RedisClient.Close()
+}
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const deliverBatchSize = 50
+
+// Deliverer periodically delivers due webhook deliveries.
+// Every webhook node runs one, and the delivery schedule in redis leases each delivery to a single node
+type Deliverer struct {
+	logger      common.HttpLog
+	deliverySvc DeliveryService
+	interval    time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func NewDeliverer(logger common.HttpLog, config *config.Config, deliverySvc DeliveryService) *Deliverer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Deliverer{
+		logger:      logger,
+		deliverySvc: deliverySvc,
+		interval:    time.Duration(config.Webhook.Delivery.IntervalMs) * time.Millisecond,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (d *Deliverer) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.deliver()
+		}
+	}
+}
+
+// deliver drains all due deliveries in batches. The deliveries of a batch are made concurrently
+// so that a slow endpoint does not hold up the others
+func (d *Deliverer) deliver() {
+	for {
+		deliveries, err := d.deliverySvc.LeaseDueDeliveries(d.ctx, deliverBatchSize)
+		if err != nil {
+			d.logger.Error(err.Error())
+			return
+		}
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			go func(delivery *Delivery) {
+				defer wg.Done()
+				// deliveries leased before shutdown are finished rather than left to their leases
+				if err := d.deliverySvc.Deliver(context.Background(), delivery); err != nil {
+					d.logger.Error(err.Error())
+				}
+			}(delivery)
+		}
+		wg.Wait()
+		if len(deliveries) < deliverBatchSize {
+			return
+		}
+	}
+}
+
+func (d *Deliverer) GracefulStop() {
+	d.cancel()
+}
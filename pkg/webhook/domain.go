@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/minghsu0107/go-random-chat/pkg/chat"
+)
+
+// Types of events delivered to webhooks
+const (
+	ChannelCreated = chat.ChannelCreated
+	UserJoined     = chat.UserJoined
+	MessageSent    = "message.sent"
+	ChannelDeleted = chat.ChannelDeleted
+)
+
+var eventTypes = map[string]struct{}{
+	ChannelCreated: {},
+	UserJoined:     {},
+	MessageSent:    {},
+	ChannelDeleted: {},
+}
+
+// Webhook is a URL subscribed to channel events. An empty Events subscribes to all event types,
+// and a zero ChannelID subscribes to all channels
+type Webhook struct {
+	ID        uint64
+	URL       string
+	Secret    string
+	Events    []string
+	ChannelID uint64
+	CreatedAt int64
+}
+
+// Event is the body of a webhook delivery. Message is only set for MessageSent
+type Event struct {
+	Type      string                 `json:"type"`
+	ChannelID string                 `json:"channel_id"`
+	UserID    string                 `json:"user_id,omitempty"`
+	Message   *chat.MessagePresenter `json:"message,omitempty"`
+	Time      int64                  `json:"time"`
+}
+
+// Delivery is an event scheduled for delivery to a webhook
+type Delivery struct {
+	ID        uint64 `json:"id"`
+	WebhookID uint64 `json:"webhook_id"`
+	Event     *Event `json:"event"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	// member is the delivery as leased from the delivery schedule, by which the lease is acked
+	member string
+}
+
+// DeadLetter records a delivery that failed all of its attempts
+type DeadLetter struct {
+	WebhookID  uint64
+	DeliveryID uint64
+	EventType  string
+	Payload    string
+	Attempts   int
+	LastError  string
+	FailedAt   int64
+}
+
+// Accepts reports whether the webhook subscribes to the event
+func (w *Webhook) Accepts(event *Event) bool {
+	if w.ChannelID != 0 && strconv.FormatUint(w.ChannelID, 10) != event.ChannelID {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, eventType := range w.Events {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) ToPresenter() *WebhookPresenter {
+	var channelID string
+	if w.ChannelID != 0 {
+		channelID = strconv.FormatUint(w.ChannelID, 10)
+	}
+	events := w.Events
+	if events == nil {
+		events = []string{}
+	}
+	return &WebhookPresenter{
+		ID:        strconv.FormatUint(w.ID, 10),
+		URL:       w.URL,
+		Events:    events,
+		ChannelID: channelID,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+func (d *DeadLetter) ToPresenter() *DeadLetterPresenter {
+	return &DeadLetterPresenter{
+		DeliveryID: strconv.FormatUint(d.DeliveryID, 10),
+		EventType:  d.EventType,
+		Payload:    d.Payload,
+		Attempts:   d.Attempts,
+		LastError:  d.LastError,
+		FailedAt:   d.FailedAt,
+	}
+}
+
+func (e *Event) Encode() []byte {
+	result, _ := json.Marshal(e)
+	return result
+}
+
+// Key identifies the event by its content, which is the same every time a redelivered event is dispatched
+func (e *Event) Key() string {
+	sum := sha256.Sum256(e.Encode())
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Delivery) Encode() []byte {
+	result, _ := json.Marshal(d)
+	return result
+}
+
+// sign returns the signature of a delivery body, which is the hex-encoded HMAC-SHA256
+// of the timestamp and the body joined by a dot, keyed by the webhook secret
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
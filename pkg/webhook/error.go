@@ -0,0 +1,10 @@
+package webhook
+
+import "errors"
+
+var (
+	ErrWebhookNotFound = errors.New("error webhook not found")
+	ErrInvalidURL      = errors.New("error invalid webhook url")
+	ErrPrivateURL      = errors.New("error webhook url resolves to a non-public address")
+	ErrInvalidEvent    = errors.New("error invalid event type")
+)
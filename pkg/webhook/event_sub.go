@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/minghsu0107/go-random-chat/pkg/chat"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/minghsu0107/go-random-chat/pkg/infra"
+)
+
+type EventSubscriber struct {
+	router      *message.Router
+	sub         message.Subscriber
+	deliverySvc DeliveryService
+}
+
+// NewKafkaSubscriber creates a subscriber in the consumer group of the webhook service,
+// so that each event is dispatched by a single webhook node
+func NewKafkaSubscriber(config *config.Config) (message.Subscriber, error) {
+	return infra.NewKafkaGroupSubscriber(config, config.Webhook.Subscriber.Group)
+}
+
+func NewEventSubscriber(name string, router *message.Router, sub message.Subscriber, deliverySvc DeliveryService) (*EventSubscriber, error) {
+	return &EventSubscriber{
+		router:      router,
+		sub:         sub,
+		deliverySvc: deliverySvc,
+	}, nil
+}
+
+func (s *EventSubscriber) HandleMessage(msg *message.Message) error {
+	message, err := chat.DecodeToMessage([]byte(msg.Payload))
+	if err != nil {
+		return err
+	}
+	return s.deliverySvc.DispatchMessage(msg.Context(), message)
+}
+
+func (s *EventSubscriber) HandleChannelEvent(msg *message.Message) error {
+	event, err := chat.DecodeToChannelEvent([]byte(msg.Payload))
+	if err != nil {
+		return err
+	}
+	return s.deliverySvc.DispatchChannelEvent(msg.Context(), event)
+}
+
+func (s *EventSubscriber) RegisterHandler() {
+	s.router.AddNoPublisherHandler(
+		"randomchat_webhook_message_handler",
+		chat.MessagePubTopic,
+		s.sub,
+		s.HandleMessage,
+	)
+	s.router.AddNoPublisherHandler(
+		"randomchat_webhook_channel_event_handler",
+		chat.ChannelEventTopic,
+		s.sub,
+		s.HandleChannelEvent,
+	)
+}
+
+func (s *EventSubscriber) Run() error {
+	return s.router.Run(context.Background())
+}
+
+func (s *EventSubscriber) GracefulStop() error {
+	return s.router.Close()
+}
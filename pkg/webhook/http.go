@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
+	prommiddleware "github.com/slok/go-http-metrics/middleware"
+	ginmiddleware "github.com/slok/go-http-metrics/middleware/gin"
+)
+
+type HttpServer struct {
+	name            string
+	logger          common.HttpLog
+	svr             *gin.Engine
+	httpPort        string
+	httpServer      *http.Server
+	apiKey          string
+	eventSubscriber *EventSubscriber
+	deliverer       *Deliverer
+	webhookSvc      WebhookService
+}
+
+func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gin.Engine {
+	svr := gin.New()
+	svr.Use(gin.Recovery())
+	svr.Use(common.CorsMiddleware())
+	svr.Use(common.LoggingMiddleware(logger))
+	svr.Use(common.MaxAllowed(config.Webhook.Http.Server.MaxConn))
+
+	mdlw := prommiddleware.New(prommiddleware.Config{
+		Recorder: metrics.NewRecorder(metrics.Config{
+			Prefix: name,
+		}),
+	})
+	svr.Use(ginmiddleware.Handler("", mdlw))
+	return svr
+}
+
+func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, eventSubscriber *EventSubscriber, deliverer *Deliverer, webhookSvc WebhookService) *HttpServer {
+	return &HttpServer{
+		name:            name,
+		logger:          logger,
+		svr:             svr,
+		httpPort:        config.Webhook.Http.Server.Port,
+		apiKey:          config.Webhook.Http.Server.ApiKey,
+		eventSubscriber: eventSubscriber,
+		deliverer:       deliverer,
+		webhookSvc:      webhookSvc,
+	}
+}
+
+// ApiKeyAuth lets through requests bearing the configured API key.
+// All requests are rejected if no API key is configured
+func (r *HttpServer) ApiKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, ok := strings.CutPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || r.apiKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(r.apiKey)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, common.ErrResponse{
+				Message: common.ErrUnauthorized.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// @title           Webhook Service Swagger API
+// @version         2.0
+// @description     Webhook service API
+
+// @contact.name   Ming Hsu
+// @contact.email  minghsu0107@gmail.com
+
+// @BasePath  /api
+func (r *HttpServer) RegisterRoutes() {
+	r.eventSubscriber.RegisterHandler()
+
+	webhookGroup := r.svr.Group("/api/webhook")
+	webhookGroup.Use(r.ApiKeyAuth())
+	{
+		webhookGroup.POST("", r.CreateWebhook)
+		webhookGroup.GET("", r.ListWebhooks)
+		webhookGroup.DELETE("", r.DeleteWebhook)
+		webhookGroup.GET("/deadletters", r.ListDeadLetters)
+	}
+}
+
+func (r *HttpServer) Run() {
+	go func() {
+		addr := ":" + r.httpPort
+		r.httpServer = &http.Server{
+			Addr:    addr,
+			Handler: common.NewOtelHttpHandler(r.svr, r.name+"_http"),
+		}
+		r.logger.Info("http server listening", slog.String("addr", addr))
+		err := r.httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			r.logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+	go func() {
+		err := r.eventSubscriber.Run()
+		if err != nil {
+			r.logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+	go r.deliverer.Run()
+}
+func (r *HttpServer) GracefulStop(ctx context.Context) error {
+	err := r.httpServer.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+	r.deliverer.GracefulStop()
+	err = r.eventSubscriber.GracefulStop()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func response(c *gin.Context, httpCode int, err error) {
+	message := err.Error()
+	c.JSON(httpCode, common.ErrResponse{
+		Message: message,
+	})
+}
@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
+
+// @Summary Create a webhook
+// @Description Register a URL to receive signed POST requests for channel events. Each request carries X-Webhook-Signature, the hex-encoded HMAC-SHA256 of X-Webhook-Timestamp and the body joined by a dot keyed by the webhook secret. A secret is generated if none is given, and it is only returned here. URLs resolving to loopback, private or link-local addresses are rejected, and so are deliveries connecting to them, unless webhook.delivery.allowPrivateNetworks is set. Leave events empty to receive all events, and channel_id empty to receive events of all channels
+// @Tags webhook
+// @Accept json
+// @Produce json
+// @param Authorization header string true "bearer API key"
+// @Param webhook body CreateWebhookPresenter true "webhook"
+// @Success 201 {object} WebhookPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /webhook [post]
+func (r *HttpServer) CreateWebhook(c *gin.Context) {
+	var req CreateWebhookPresenter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var channelID uint64
+	if req.ChannelID != "" {
+		var err error
+		channelID, err = strconv.ParseUint(req.ChannelID, 10, 64)
+		if err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	webhook, err := r.webhookSvc.CreateWebhook(c.Request.Context(), req.URL, req.Secret, req.Events, channelID)
+	if err != nil {
+		if errors.Is(err, ErrInvalidURL) || errors.Is(err, ErrPrivateURL) || errors.Is(err, ErrInvalidEvent) {
+			response(c, http.StatusBadRequest, err)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	presenter := webhook.ToPresenter()
+	presenter.Secret = webhook.Secret
+	c.JSON(http.StatusCreated, presenter)
+}
+
+// @Summary List webhooks
+// @Description List all registered webhooks without their secrets
+// @Tags webhook
+// @Produce json
+// @param Authorization header string true "bearer API key"
+// @Success 200 {object} WebhooksPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /webhook [get]
+func (r *HttpServer) ListWebhooks(c *gin.Context) {
+	webhooks, err := r.webhookSvc.GetWebhooks(c.Request.Context())
+	if err != nil {
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	presenters := []WebhookPresenter{}
+	for _, webhook := range webhooks {
+		presenters = append(presenters, *webhook.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &WebhooksPresenter{
+		Webhooks: presenters,
+	})
+}
+
+// @Summary Delete a webhook
+// @Description Delete the webhook and its dead letters. Pending deliveries to it are dropped
+// @Tags webhook
+// @Produce json
+// @param Authorization header string true "bearer API key"
+// @param id query string true "webhook id"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /webhook [delete]
+func (r *HttpServer) DeleteWebhook(c *gin.Context) {
+	webhookID, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if err := r.webhookSvc.DeleteWebhook(c.Request.Context(), webhookID); err != nil {
+		if errors.Is(err, ErrWebhookNotFound) {
+			response(c, http.StatusNotFound, ErrWebhookNotFound)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
+	})
+}
+
+// @Summary List dead letters
+// @Description List the most recent deliveries to the webhook that failed all of their attempts, newest first
+// @Tags webhook
+// @Produce json
+// @param Authorization header string true "bearer API key"
+// @param id query string true "webhook id"
+// @Success 200 {object} DeadLettersPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /webhook/deadletters [get]
+func (r *HttpServer) ListDeadLetters(c *gin.Context) {
+	webhookID, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	deadLetters, err := r.webhookSvc.GetDeadLetters(c.Request.Context(), webhookID)
+	if err != nil {
+		if errors.Is(err, ErrWebhookNotFound) {
+			response(c, http.StatusNotFound, ErrWebhookNotFound)
+			return
+		}
+		r.logger.Error(err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	presenters := []DeadLetterPresenter{}
+	for _, deadLetter := range deadLetters {
+		presenters = append(presenters, *deadLetter.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &DeadLettersPresenter{
+		DeadLetters: presenters,
+	})
+}
@@ -0,0 +1,34 @@
+package webhook
+
+type CreateWebhookPresenter struct {
+	URL       string   `json:"url" binding:"required"`
+	Secret    string   `json:"secret"`
+	Events    []string `json:"events"`
+	ChannelID string   `json:"channel_id"`
+}
+
+type WebhookPresenter struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events"`
+	ChannelID string   `json:"channel_id,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+type WebhooksPresenter struct {
+	Webhooks []WebhookPresenter `json:"webhooks"`
+}
+
+type DeadLetterPresenter struct {
+	DeliveryID string `json:"delivery_id"`
+	EventType  string `json:"event_type"`
+	Payload    string `json:"payload"`
+	Attempts   int    `json:"attempts"`
+	LastError  string `json:"last_error"`
+	FailedAt   int64  `json:"failed_at"`
+}
+
+type DeadLettersPresenter struct {
+	DeadLetters []DeadLetterPresenter `json:"dead_letters"`
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/gocql/gocql"
+)
+
+// deadLetterLimit is the number of most recent dead letters returned for a webhook
+const deadLetterLimit = 100
+
+type WebhookRepo interface {
+	CreateWebhook(ctx context.Context, webhook *Webhook) error
+	GetWebhook(ctx context.Context, webhookID uint64) (*Webhook, error)
+	GetWebhooks(ctx context.Context) ([]*Webhook, error)
+	DeleteWebhook(ctx context.Context, webhookID uint64) error
+	InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error
+	GetDeadLetters(ctx context.Context, webhookID uint64) ([]*DeadLetter, error)
+}
+
+type WebhookRepoImpl struct {
+	s *gocql.Session
+}
+
+func NewWebhookRepoImpl(s *gocql.Session) *WebhookRepoImpl {
+	return &WebhookRepoImpl{s}
+}
+
+func (repo *WebhookRepoImpl) CreateWebhook(ctx context.Context, webhook *Webhook) error {
+	if err := repo.s.Query("INSERT INTO webhooks (id, url, secret, events, channel_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		webhook.ID, webhook.URL, webhook.Secret, webhook.Events, webhook.ChannelID, webhook.CreatedAt).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *WebhookRepoImpl) GetWebhook(ctx context.Context, webhookID uint64) (*Webhook, error) {
+	webhook := Webhook{ID: webhookID}
+	if err := repo.s.Query("SELECT url, secret, events, channel_id, created_at FROM webhooks WHERE id = ? LIMIT 1", webhookID).
+		WithContext(ctx).Idempotent(true).Scan(&webhook.URL, &webhook.Secret, &webhook.Events, &webhook.ChannelID, &webhook.CreatedAt); err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// GetWebhooks returns all registered webhooks. The number of webhooks is expected to be small
+func (repo *WebhookRepoImpl) GetWebhooks(ctx context.Context) ([]*Webhook, error) {
+	iter := repo.s.Query("SELECT id, url, secret, events, channel_id, created_at FROM webhooks").
+		WithContext(ctx).Idempotent(true).Iter()
+	var webhooks []*Webhook
+	var webhook Webhook
+	for iter.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &webhook.Events, &webhook.ChannelID, &webhook.CreatedAt) {
+		w := webhook
+		webhooks = append(webhooks, &w)
+		webhook.Events = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes the webhook and its dead letters
+func (repo *WebhookRepoImpl) DeleteWebhook(ctx context.Context, webhookID uint64) error {
+	if err := repo.s.Query("DELETE FROM webhooks WHERE id = ?", webhookID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM webhook_dead_letters WHERE webhook_id = ?", webhookID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *WebhookRepoImpl) InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	if err := repo.s.Query("INSERT INTO webhook_dead_letters (webhook_id, delivery_id, event_type, payload, attempts, last_error, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		deadLetter.WebhookID, deadLetter.DeliveryID, deadLetter.EventType, deadLetter.Payload, deadLetter.Attempts, deadLetter.LastError, deadLetter.FailedAt).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+func (repo *WebhookRepoImpl) GetDeadLetters(ctx context.Context, webhookID uint64) ([]*DeadLetter, error) {
+	iter := repo.s.Query("SELECT delivery_id, event_type, payload, attempts, last_error, failed_at FROM webhook_dead_letters WHERE webhook_id = ? LIMIT ?", webhookID, deadLetterLimit).
+		WithContext(ctx).Idempotent(true).Iter()
+	var deadLetters []*DeadLetter
+	var deliveryID uint64
+	var eventType, payload, lastError string
+	var attempts int
+	var failedAt int64
+	for iter.Scan(&deliveryID, &eventType, &payload, &attempts, &lastError, &failedAt) {
+		deadLetters = append(deadLetters, &DeadLetter{
+			WebhookID:  webhookID,
+			DeliveryID: deliveryID,
+			EventType:  eventType,
+			Payload:    payload,
+			Attempts:   attempts,
+			LastError:  lastError,
+			FailedAt:   failedAt,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
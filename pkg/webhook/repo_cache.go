@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+
+	"github.com/minghsu0107/go-random-chat/pkg/infra"
+)
+
+var (
+	webhooksKey            = "rc:webhooks"
+	deliveryKey            = "rc:webhook:deliveries"
+	undecodableDeliveryKey = "rc:webhook:deliveries:undecodable"
+	dispatchedPrefix       = "rc:webhook:dispatched"
+)
+
+type WebhookRepoCache interface {
+	CreateWebhook(ctx context.Context, webhook *Webhook) error
+	GetWebhook(ctx context.Context, webhookID uint64) (*Webhook, error)
+	GetWebhooks(ctx context.Context) ([]*Webhook, error)
+	DeleteWebhook(ctx context.Context, webhookID uint64) error
+	InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error
+	GetDeadLetters(ctx context.Context, webhookID uint64) ([]*DeadLetter, error)
+	ReserveDispatch(ctx context.Context, eventKey string, webhookID uint64, ttl time.Duration) (bool, error)
+	ReleaseDispatch(ctx context.Context, eventKey string, webhookID uint64) error
+	ScheduleDelivery(ctx context.Context, delivery *Delivery, at int64) error
+	LeaseDueDeliveries(ctx context.Context, before int64, leaseUntil int64, count int64) ([]*Delivery, error)
+	AckDelivery(ctx context.Context, delivery *Delivery) error
+}
+
+type WebhookRepoCacheImpl struct {
+	r           infra.RedisCache
+	webhookRepo WebhookRepo
+}
+
+func NewWebhookRepoCacheImpl(r infra.RedisCache, webhookRepo WebhookRepo) *WebhookRepoCacheImpl {
+	return &WebhookRepoCacheImpl{r, webhookRepo}
+}
+
+func (cache *WebhookRepoCacheImpl) CreateWebhook(ctx context.Context, webhook *Webhook) error {
+	if err := cache.webhookRepo.CreateWebhook(ctx, webhook); err != nil {
+		return err
+	}
+	return cache.r.Delete(ctx, webhooksKey)
+}
+func (cache *WebhookRepoCacheImpl) GetWebhook(ctx context.Context, webhookID uint64) (*Webhook, error) {
+	return cache.webhookRepo.GetWebhook(ctx, webhookID)
+}
+
+// GetWebhooks returns all webhooks, which every event is matched against, from the cache
+func (cache *WebhookRepoCacheImpl) GetWebhooks(ctx context.Context) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	exist, err := cache.r.Get(ctx, webhooksKey, &webhooks)
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return webhooks, nil
+	}
+	webhooks, err = cache.webhookRepo.GetWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(webhooks)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.r.Set(ctx, webhooksKey, data); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+func (cache *WebhookRepoCacheImpl) DeleteWebhook(ctx context.Context, webhookID uint64) error {
+	if err := cache.webhookRepo.DeleteWebhook(ctx, webhookID); err != nil {
+		return err
+	}
+	return cache.r.Delete(ctx, webhooksKey)
+}
+func (cache *WebhookRepoCacheImpl) InsertDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	return cache.webhookRepo.InsertDeadLetter(ctx, deadLetter)
+}
+func (cache *WebhookRepoCacheImpl) GetDeadLetters(ctx context.Context, webhookID uint64) ([]*DeadLetter, error) {
+	return cache.webhookRepo.GetDeadLetters(ctx, webhookID)
+}
+
+// ReserveDispatch marks the event as dispatched to the webhook, and reports false if it already was
+func (cache *WebhookRepoCacheImpl) ReserveDispatch(ctx context.Context, eventKey string, webhookID uint64, ttl time.Duration) (bool, error) {
+	return cache.r.SetNX(ctx, constructDispatchKey(eventKey, webhookID), 1, ttl)
+}
+func (cache *WebhookRepoCacheImpl) ReleaseDispatch(ctx context.Context, eventKey string, webhookID uint64) error {
+	return cache.r.Delete(ctx, constructDispatchKey(eventKey, webhookID))
+}
+
+// ScheduleDelivery puts the delivery on the delivery schedule to be attempted at the given time
+func (cache *WebhookRepoCacheImpl) ScheduleDelivery(ctx context.Context, delivery *Delivery, at int64) error {
+	return cache.r.ZAddOne(ctx, deliveryKey, float64(at), delivery.Encode())
+}
+
+// LeaseDueDeliveries hands out deliveries due before the given time until the lease ends.
+// Each delivery is leased by exactly one webhook node at a time, and it stays on the delivery schedule
+// to be leased again unless it is acked, so that a failed or crashed node loses no delivery.
+// Undecodable deliveries are moved aside for inspection instead of holding up the schedule
+func (cache *WebhookRepoCacheImpl) LeaseDueDeliveries(ctx context.Context, before int64, leaseUntil int64, count int64) ([]*Delivery, error) {
+	members, err := cache.r.ZLeaseByScore(ctx, deliveryKey, float64(before), float64(leaseUntil), count)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*Delivery
+	for _, member := range members {
+		delivery, err := DecodeToDelivery([]byte(member))
+		if err != nil {
+			if err := cache.r.RPush(ctx, undecodableDeliveryKey, member); err != nil {
+				return nil, err
+			}
+			if err := cache.r.ZRemOne(ctx, deliveryKey, member); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		delivery.member = member
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// AckDelivery takes a leased delivery off the delivery schedule
+func (cache *WebhookRepoCacheImpl) AckDelivery(ctx context.Context, delivery *Delivery) error {
+	return cache.r.ZRemOne(ctx, deliveryKey, delivery.member)
+}
+
+func constructDispatchKey(eventKey string, webhookID uint64) string {
+	return common.Join(dispatchedPrefix, ":", eventKey, ":", strconv.FormatUint(webhookID, 10))
+}
@@ -0,0 +1,343 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/chat"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	secretBytes = 32
+	// maxResponseBytes bounds how much of a response body is read before the connection is reused
+	maxResponseBytes = 64 * 1024
+	// maxLastErrorLen bounds the error recorded on a delivery, which travels with it through redis
+	maxLastErrorLen = 256
+	// dispatchDedupTTL is how long a dispatched event is remembered, so that redelivered events are not delivered twice
+	dispatchDedupTTL = 24 * time.Hour
+)
+
+type WebhookService interface {
+	CreateWebhook(ctx context.Context, rawURL, secret string, events []string, channelID uint64) (*Webhook, error)
+	GetWebhooks(ctx context.Context) ([]*Webhook, error)
+	DeleteWebhook(ctx context.Context, webhookID uint64) error
+	GetDeadLetters(ctx context.Context, webhookID uint64) ([]*DeadLetter, error)
+}
+
+type DeliveryService interface {
+	DispatchMessage(ctx context.Context, msg *chat.Message) error
+	DispatchChannelEvent(ctx context.Context, event *chat.ChannelEvent) error
+	LeaseDueDeliveries(ctx context.Context, count int64) ([]*Delivery, error)
+	Deliver(ctx context.Context, delivery *Delivery) error
+}
+
+type WebhookServiceImpl struct {
+	webhookRepo          WebhookRepoCache
+	sf                   common.IDGenerator
+	allowPrivateNetworks bool
+}
+
+func NewWebhookServiceImpl(config *config.Config, webhookRepo WebhookRepoCache, sf common.IDGenerator) *WebhookServiceImpl {
+	return &WebhookServiceImpl{webhookRepo, sf, config.Webhook.Delivery.AllowPrivateNetworks}
+}
+
+// CreateWebhook registers a webhook. A secret is generated if none is given.
+// URLs resolving to non-public addresses are rejected unless private networks are allowed
+func (svc *WebhookServiceImpl) CreateWebhook(ctx context.Context, rawURL, secret string, events []string, channelID uint64) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, ErrInvalidURL
+	}
+	if !svc.allowPrivateNetworks {
+		if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	for _, event := range events {
+		if _, ok := eventTypes[event]; !ok {
+			return nil, ErrInvalidEvent
+		}
+	}
+	if secret == "" {
+		b := make([]byte, secretBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("error create webhook secret: %w", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+	webhookID, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create webhook id: %w", err)
+	}
+	webhook := &Webhook{
+		ID:        webhookID,
+		URL:       rawURL,
+		Secret:    secret,
+		Events:    events,
+		ChannelID: channelID,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := svc.webhookRepo.CreateWebhook(ctx, webhook); err != nil {
+		return nil, fmt.Errorf("error create webhook %d: %w", webhookID, err)
+	}
+	return webhook, nil
+}
+func (svc *WebhookServiceImpl) GetWebhooks(ctx context.Context) ([]*Webhook, error) {
+	webhooks, err := svc.webhookRepo.GetWebhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error get webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+func (svc *WebhookServiceImpl) DeleteWebhook(ctx context.Context, webhookID uint64) error {
+	if _, err := svc.webhookRepo.GetWebhook(ctx, webhookID); err != nil {
+		return fmt.Errorf("error get webhook %d: %w", webhookID, err)
+	}
+	if err := svc.webhookRepo.DeleteWebhook(ctx, webhookID); err != nil {
+		return fmt.Errorf("error delete webhook %d: %w", webhookID, err)
+	}
+	return nil
+}
+func (svc *WebhookServiceImpl) GetDeadLetters(ctx context.Context, webhookID uint64) ([]*DeadLetter, error) {
+	if _, err := svc.webhookRepo.GetWebhook(ctx, webhookID); err != nil {
+		return nil, fmt.Errorf("error get webhook %d: %w", webhookID, err)
+	}
+	deadLetters, err := svc.webhookRepo.GetDeadLetters(ctx, webhookID)
+	if err != nil {
+		return nil, fmt.Errorf("error get dead letters of webhook %d: %w", webhookID, err)
+	}
+	return deadLetters, nil
+}
+
+// DeliveryServiceImpl delivers events to webhooks as signed HTTP POST requests.
+// A failed attempt is retried with exponential backoff, and a delivery that fails
+// all of its attempts is recorded as a dead letter. Connections to non-public addresses are refused
+// unless private networks are allowed. A delivery is leased while it is attempted,
+// and it is attempted again once the lease ends unless the outcome of the attempt is recorded
+type DeliveryServiceImpl struct {
+	webhookRepo WebhookRepoCache
+	sf          common.IDGenerator
+	client      *http.Client
+	maxAttempts int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	lease       time.Duration
+	deliveries  *prometheus.CounterVec
+}
+
+func NewDeliveryServiceImpl(name string, config *config.Config, webhookRepo WebhookRepoCache, sf common.IDGenerator) *DeliveryServiceImpl {
+	delivery := config.Webhook.Delivery
+	client := &http.Client{
+		Timeout: time.Duration(delivery.TimeoutMs) * time.Millisecond,
+	}
+	if !delivery.AllowPrivateNetworks {
+		client.Transport = newPublicTransport()
+	}
+	return &DeliveryServiceImpl{
+		webhookRepo: webhookRepo,
+		sf:          sf,
+		client:      client,
+		maxAttempts: delivery.MaxAttempts,
+		backoffBase: time.Duration(delivery.BackoffBaseMs) * time.Millisecond,
+		backoffMax:  time.Duration(delivery.BackoffMaxMs) * time.Millisecond,
+		lease:       time.Duration(delivery.LeaseMs) * time.Millisecond,
+		deliveries: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   name,
+			Name:        "webhook_deliveries_total",
+			Help:        "Total number of webhook delivery attempts by result.",
+			ConstLabels: prometheus.Labels{"serviceID": name},
+		}, []string{"result"}),
+	}
+}
+
+// DispatchMessage schedules a MessageSent event for text and file messages. Other messages are ignored
+func (svc *DeliveryServiceImpl) DispatchMessage(ctx context.Context, msg *chat.Message) error {
+	if msg.Event != chat.EventText && msg.Event != chat.EventFile {
+		return nil
+	}
+	return svc.dispatch(ctx, &Event{
+		Type:      MessageSent,
+		ChannelID: strconv.FormatUint(msg.ChannelID, 10),
+		UserID:    strconv.FormatUint(msg.UserID, 10),
+		Message:   msg.ToPresenter(),
+		Time:      msg.Time,
+	})
+}
+func (svc *DeliveryServiceImpl) DispatchChannelEvent(ctx context.Context, event *chat.ChannelEvent) error {
+	var userID string
+	if event.UserID != 0 {
+		userID = strconv.FormatUint(event.UserID, 10)
+	}
+	return svc.dispatch(ctx, &Event{
+		Type:      event.Type,
+		ChannelID: strconv.FormatUint(event.ChannelID, 10),
+		UserID:    userID,
+		Time:      event.Time,
+	})
+}
+
+// dispatch schedules an immediate delivery of the event to every webhook subscribed to it.
+// Each event is scheduled at most once per webhook, so a redelivered event that failed partway
+// only schedules the deliveries that were not scheduled before
+func (svc *DeliveryServiceImpl) dispatch(ctx context.Context, event *Event) error {
+	webhooks, err := svc.webhookRepo.GetWebhooks(ctx)
+	if err != nil {
+		return fmt.Errorf("error get webhooks: %w", err)
+	}
+	eventKey := event.Key()
+	now := time.Now().UnixMilli()
+	for _, webhook := range webhooks {
+		if !webhook.Accepts(event) {
+			continue
+		}
+		reserved, err := svc.webhookRepo.ReserveDispatch(ctx, eventKey, webhook.ID, dispatchDedupTTL)
+		if err != nil {
+			return fmt.Errorf("error reserve dispatch to webhook %d: %w", webhook.ID, err)
+		}
+		if !reserved {
+			continue
+		}
+		if err := svc.scheduleDispatch(ctx, event, webhook, now); err != nil {
+			if err := svc.webhookRepo.ReleaseDispatch(ctx, eventKey, webhook.ID); err != nil {
+				return fmt.Errorf("error release dispatch to webhook %d: %w", webhook.ID, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+func (svc *DeliveryServiceImpl) scheduleDispatch(ctx context.Context, event *Event, webhook *Webhook, at int64) error {
+	deliveryID, err := svc.sf.NextID()
+	if err != nil {
+		return fmt.Errorf("error create delivery id: %w", err)
+	}
+	delivery := &Delivery{
+		ID:        deliveryID,
+		WebhookID: webhook.ID,
+		Event:     event,
+	}
+	if err := svc.webhookRepo.ScheduleDelivery(ctx, delivery, at); err != nil {
+		return fmt.Errorf("error schedule delivery %d to webhook %d: %w", deliveryID, webhook.ID, err)
+	}
+	return nil
+}
+func (svc *DeliveryServiceImpl) LeaseDueDeliveries(ctx context.Context, count int64) ([]*Delivery, error) {
+	now := time.Now()
+	deliveries, err := svc.webhookRepo.LeaseDueDeliveries(ctx, now.UnixMilli(), now.Add(svc.lease).UnixMilli(), count)
+	if err != nil {
+		return nil, fmt.Errorf("error lease due deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// Deliver makes one attempt of the delivery. A failed attempt is rescheduled after a backoff,
+// or recorded as a dead letter once the delivery runs out of attempts.
+// Deliveries to deleted webhooks are dropped
+func (svc *DeliveryServiceImpl) Deliver(ctx context.Context, delivery *Delivery) error {
+	webhook, err := svc.webhookRepo.GetWebhook(ctx, delivery.WebhookID)
+	if err != nil {
+		if errors.Is(err, ErrWebhookNotFound) {
+			return svc.ack(ctx, delivery)
+		}
+		return fmt.Errorf("error get webhook %d: %w", delivery.WebhookID, err)
+	}
+	delivery.Attempts++
+	body := delivery.Event.Encode()
+	err = svc.post(ctx, webhook, delivery, body)
+	if err == nil {
+		svc.deliveries.WithLabelValues("success").Inc()
+		return svc.ack(ctx, delivery)
+	}
+	delivery.LastError = err.Error()
+	if len(delivery.LastError) > maxLastErrorLen {
+		delivery.LastError = delivery.LastError[:maxLastErrorLen]
+	}
+	if delivery.Attempts < svc.maxAttempts {
+		svc.deliveries.WithLabelValues("retry").Inc()
+		at := time.Now().Add(svc.backoff(delivery.Attempts)).UnixMilli()
+		if err := svc.webhookRepo.ScheduleDelivery(ctx, delivery, at); err != nil {
+			return fmt.Errorf("error reschedule delivery %d to webhook %d: %w", delivery.ID, webhook.ID, err)
+		}
+		return svc.ack(ctx, delivery)
+	}
+	svc.deliveries.WithLabelValues("dead").Inc()
+	if err := svc.webhookRepo.InsertDeadLetter(ctx, &DeadLetter{
+		WebhookID:  webhook.ID,
+		DeliveryID: delivery.ID,
+		EventType:  delivery.Event.Type,
+		Payload:    string(body),
+		Attempts:   delivery.Attempts,
+		LastError:  delivery.LastError,
+		FailedAt:   time.Now().UnixMilli(),
+	}); err != nil {
+		return fmt.Errorf("error insert dead letter of delivery %d to webhook %d: %w", delivery.ID, webhook.ID, err)
+	}
+	return svc.ack(ctx, delivery)
+}
+
+// ack ends the lease of the delivery once the outcome of its attempt is recorded
+func (svc *DeliveryServiceImpl) ack(ctx context.Context, delivery *Delivery) error {
+	if err := svc.webhookRepo.AckDelivery(ctx, delivery); err != nil {
+		return fmt.Errorf("error ack delivery %d to webhook %d: %w", delivery.ID, delivery.WebhookID, err)
+	}
+	return nil
+}
+
+// post sends the signed delivery to the webhook. Any response other than 2xx is a failure
+func (svc *DeliveryServiceImpl) post(ctx context.Context, webhook *Webhook, delivery *Delivery, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event.Type)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(delivery.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", sign(webhook.Secret, timestamp, body))
+	resp, err := svc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt, which doubles with every attempt up to the maximum.
+// The delay is jittered between half and all of it so that retries to a recovering endpoint are spread out
+func (svc *DeliveryServiceImpl) backoff(attempts int) time.Duration {
+	delay := svc.backoffBase
+	for i := 1; i < attempts && delay < svc.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > svc.backoffMax {
+		delay = svc.backoffMax
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(half)))
+	if err != nil {
+		return delay
+	}
+	return half + time.Duration(jitter.Int64())
+}
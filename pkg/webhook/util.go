@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// cgnatNet is the shared address space of carrier-grade NAT, which net.IP does not count as private
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func DecodeToDelivery(data []byte) (*Delivery, error) {
+	var delivery Delivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// isPublicIP reports whether the IP is a globally routable unicast address. Loopback, private,
+// link-local and other internal addresses, such as cloud metadata endpoints, are not
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnatNet.Contains(ip)
+}
+
+// checkPublicHost rejects the host if it does not resolve or any of its addresses is not public
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return ErrInvalidURL
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return ErrPrivateURL
+		}
+	}
+	return nil
+}
+
+// newPublicTransport returns a transport that refuses to connect to addresses that are not public.
+// The check runs on the resolved address of every connection, so that neither DNS rebinding
+// nor redirects can reach internal addresses with a webhook registered under a public host
+func newPublicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return ErrPrivateURL
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
@@ -11,6 +11,22 @@ const EVENT_TEXT = 0
 const EVENT_ACTION = 1
 const EVENT_SEEN = 2
 const EVENT_FILE = 3
+const EVENT_ERROR = 4
+const EVENT_EDIT = 5
+const EVENT_DELETE = 6
+const EVENT_EXPIRE = 8
+const EVENT_ACK = 9
+const EVENT_PIN = 10
+const EVENT_UNPIN = 11
+const EVENT_KEY_EXCHANGE = 12
+
+// text messages waiting for their ack, keyed by correlation ID,
+// which doubles as the idempotency key so that resending them never creates duplicates
+var pendingTexts = {}
+
+function nextCorrelationID() {
+    return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`
+}
 
 var ws
 
@@ -58,17 +74,70 @@ async function start() {
     if (!isLogin) {
         window.location.href = '/'
     } else {
-        var protocol
-        var loc = window.location
-        if (loc.protocol === "https:") {
-            protocol = "wss:"
-        } else {
-            protocol = "ws:"
+        try {
+            await refreshAccessToken()
+        } catch (err) {
+            console.log(`Error: ${err}`)
         }
-        var chatUrl = protocol + "//" + window.location.host + "/api/chat?uid=" + USER_ID + "&access_token=" + ACCESS_TOKEN
-        connectWebSocket(chatUrl)
+        connectWebSocket(getChatUrl())
     }
 }
+
+function getChatUrl() {
+    if (useStream) {
+        return "/api/chat/stream?uid=" + USER_ID + "&access_token=" + ACCESS_TOKEN
+    }
+    var protocol
+    var loc = window.location
+    if (loc.protocol === "https:") {
+        protocol = "wss:"
+    } else {
+        protocol = "ws:"
+    }
+    return protocol + "//" + window.location.host + "/api/chat?uid=" + USER_ID + "&access_token=" + ACCESS_TOKEN
+}
+
+const tokenRefreshMarginMs = 60 * 1000
+
+function getTokenExpiry(token) {
+    try {
+        var claims = JSON.parse(atob(token.split(".")[1].replace(/-/g, "+").replace(/_/g, "/")))
+        return claims.exp * 1000
+    } catch (err) {
+        return 0
+    }
+}
+
+// refreshAccessToken exchanges the channel access token for a new one when it is about to expire
+async function refreshAccessToken() {
+    // the token is shared by all tabs, so another tab may have refreshed it already
+    var storedToken = localStorage.getItem(accessTokenKey)
+    if (storedToken !== null) {
+        ACCESS_TOKEN = storedToken
+    }
+    if (getTokenExpiry(ACCESS_TOKEN) - Date.now() > tokenRefreshMarginMs) {
+        return
+    }
+    return fetch(`/api/chat/channel/token?uid=${USER_ID}`, {
+        method: 'POST',
+        headers: new Headers({
+            'Content-Type': 'application/json'
+        }),
+        body: JSON.stringify({
+            "access_token": ACCESS_TOKEN
+        })
+    })
+        .then((response) => {
+            if (response.status !== 200) {
+                throw Error(response.statusText)
+            }
+            return response.json()
+        })
+        .then((result) => {
+            ACCESS_TOKEN = result.access_token
+            localStorage.setItem(accessTokenKey, ACCESS_TOKEN)
+        })
+}
 start()
 
 var ONLINE_USERS = new Set()
@@ -127,18 +196,18 @@ chatroom[0].addEventListener("touchstart", function (e) {
 })
 
 function markMessagesAsSeen() {
-    for (let i = peerMessages.length - 1; i >= 0; i--) {
-        if (peerMessages[i].seen) {
-            break
-        } else {
-            peerMessages[i].seen = true
-            ws.send(JSON.stringify({
-                "event": EVENT_SEEN,
-                "user_id": peerMessages[i].user_id,
-                "payload": peerMessages[i].message_id,
-            }))
-        }
+    if (peerMessages.length === 0 || peerMessages[peerMessages.length - 1].seen) {
+        return
+    }
+    for (let i = peerMessages.length - 1; i >= 0 && !peerMessages[i].seen; i--) {
+        peerMessages[i].seen = true
     }
+    // the server keeps a read watermark per user, so sending the latest message is enough
+    ws.send(JSON.stringify({
+        "event": EVENT_SEEN,
+        "user_id": USER_ID,
+        "payload": peerMessages[peerMessages.length - 1].message_id,
+    }))
 }
 
 /*
@@ -271,13 +340,71 @@ text.onkeydown = function (e) {
     }
 }
 
+// useStream switches to server-sent events and http posts once a websocket fails to open,
+// for example behind a proxy that blocks websockets
+var useStream = false
+
+// StreamConn provides the part of the WebSocket interface used by the chat,
+// receiving frames from an event source and sending them with http posts
+class StreamConn extends EventTarget {
+    constructor(url) {
+        super()
+        this.closed = false
+        this.streamId = null
+        this.source = new EventSource(url)
+        // the connection is ready to send frames once the server names it
+        this.source.addEventListener('stream', (e) => {
+            this.streamId = e.data
+            this.dispatchEvent(new Event('open'))
+        })
+        this.source.onmessage = (e) => this.dispatchFrame(e.data)
+        // reconnect with a refreshed token like a websocket does, instead of letting the event source retry
+        this.source.onerror = () => this.close()
+    }
+    dispatchFrame(data) {
+        let e = new Event('message')
+        e.data = data
+        this.dispatchEvent(e)
+    }
+    send(data) {
+        fetch(`/api/chat/stream`, {
+            method: 'POST',
+            headers: new Headers({
+                'Content-Type': 'application/json',
+                'Authorization': 'Bearer ' + ACCESS_TOKEN,
+                'X-Stream-Id': this.streamId
+            }),
+            body: data
+        })
+            .then((response) => response.json())
+            .then((result) => {
+                // the ack or error frame of the sent frame
+                this.dispatchFrame(JSON.stringify(result))
+            })
+            .catch(err => {
+                console.log(`Error: ${err}`)
+            })
+    }
+    close() {
+        if (this.closed) {
+            return
+        }
+        this.closed = true
+        this.source.close()
+        this.dispatchEvent(new Event('close'))
+    }
+}
+
 function connectWebSocket(chatUrl) {
-    ws = new WebSocket(chatUrl)
+    var opened = false
+    ws = useStream ? new StreamConn(chatUrl) : new WebSocket(chatUrl)
     ws.addEventListener('open', async function (e) {
+        opened = true
         try {
             insertDummy()
             await getAllChannelUserNames()
             await fetchMessages()
+            resendPendingTexts()
         } catch (err) {
             console.log(`Error: ${err}`)
         }
@@ -285,11 +412,27 @@ function connectWebSocket(chatUrl) {
     })
     ws.addEventListener('message', async function (e) {
         var m = JSON.parse(e.data)
+        if (m.event === EVENT_ACK) {
+            delete pendingTexts[m.correlation_id]
+            return
+        }
+        if (m.event === EVENT_ERROR) {
+            console.log(`Error (${m.code}): ${m.payload}`)
+            // give the dropped text back to the sender so it can be fixed and resent
+            if (m.correlation_id in pendingTexts) {
+                if (onlySpaces(text.value)) {
+                    text.value = pendingTexts[m.correlation_id]
+                }
+                delete pendingTexts[m.correlation_id]
+            }
+            return
+        }
         if (m.event === EVENT_ACTION) {
             switch (m.payload) {
                 case "waiting":
                 case "joined":
                 case "offline":
+                case "invited":
                     try {
                         await updateOnlineUsers()
                     } catch (err) {
@@ -312,6 +455,19 @@ function connectWebSocket(chatUrl) {
                     ACCESS_TOKEN = ""
                     ws.close()
                     break
+                case "left":
+                    if (m.user_id === USER_ID) {
+                        localStorage.removeItem(accessTokenKey)
+                        ACCESS_TOKEN = ""
+                        ws.close()
+                        break
+                    }
+                    try {
+                        await updateOnlineUsers()
+                    } catch (err) {
+                        console.log(`Error: ${err}`)
+                    }
+                    break
             }
         }
         var msg = await processMessage(m)
@@ -350,9 +506,17 @@ function connectWebSocket(chatUrl) {
     `
         document.getElementById("msg").disabled = true
         fileInput.disabled = true
+        if (!opened && !useStream) {
+            useStream = true
+        }
         if (ACCESS_TOKEN !== "" && !isPageHidden) {
-            setTimeout(function () {
-                connectWebSocket()
+            setTimeout(async function () {
+                try {
+                    await refreshAccessToken()
+                } catch (err) {
+                    console.log(`Error: ${err}`)
+                }
+                connectWebSocket(getChatUrl())
             }, 1000)
         }
     })
@@ -466,9 +630,19 @@ async function fetchMessages() {
 }
 
 async function processMessage(m) {
+    if (m.deleted && m.event !== EVENT_DELETE) {
+        return ""
+    }
     if (!(m.user_id in ID2NAME)) {
         await setPeer(m.user_id)
     }
+    // this client holds no end-to-end encryption keys, so ciphertext is shown as a placeholder
+    if (m.encryption && (m.event === EVENT_TEXT || m.event === EVENT_FILE || m.event === EVENT_EDIT)) {
+        m.payload = "[encrypted message]"
+        if (m.event === EVENT_FILE) {
+            m.event = EVENT_TEXT
+        }
+    }
     var msg = ""
     switch (m.event) {
         case EVENT_TEXT:
@@ -494,6 +668,14 @@ async function processMessage(m) {
                         actionMsg = ID2NAME[m.user_id] + " leaved, channel closed"
                     }
                     break
+                case "invited":
+                    actionMsg = ID2NAME[m.user_id] + " was invited"
+                    break
+                case "left":
+                    if (m.user_id !== USER_ID) {
+                        actionMsg = ID2NAME[m.user_id] + " left"
+                    }
+                    break
                 case "istyping":
                     if (m.user_id !== USER_ID) {
                         msg = await getTypingMessage(m.user_id, LEFT, peerTypingID)
@@ -505,16 +687,36 @@ async function processMessage(m) {
             }
             break
         case EVENT_SEEN:
-            if (m.user_id === USER_ID) {
-                let id = `seen-${m.payload}`
-                let el = document.getElementById(id)
-                while (el === null) {
-                    await sleep(250)
-                    el = document.getElementById(id)
+            if (m.user_id !== USER_ID) {
+                for (const el of document.getElementsByClassName("msg-info-seen")) {
+                    if (BigInt(el.id.substring("seen-".length)) <= BigInt(m.payload)) {
+                        el.textContent = "seen"
+                    }
                 }
-                el.textContent = "seen"
             }
             break
+        case EVENT_EDIT:
+            let editedEl = document.getElementById(`${m.message_id}`)
+            if (editedEl !== null) {
+                editedEl.querySelector(".msg-text").innerHTML = urlify(m.payload).replace(/(?:\r|\n|\r\n)/g, '<br>')
+            }
+            break
+        case EVENT_DELETE:
+        case EVENT_EXPIRE:
+            let deletedEl = document.getElementById(`${m.message_id}`)
+            if (deletedEl !== null) {
+                deletedEl.remove()
+            }
+            break
+        case EVENT_PIN:
+            msg = getActionMessage(ID2NAME[m.user_id] + " pinned a message")
+            break
+        case EVENT_UNPIN:
+            msg = getActionMessage(ID2NAME[m.user_id] + " unpinned a message")
+            break
+        case EVENT_KEY_EXCHANGE:
+            // public keys are only used by clients that encrypt messages
+            break
         case EVENT_FILE:
             let d1 = new Date(m.time)
             var time1 = `${d1.getFullYear()}/${d1.getMonth() + 1}/${d1.getDate()} ${String(d1.getHours()).padStart(2, "0")}:${String(d1.getMinutes()).padStart(2, "0")}`
@@ -628,15 +830,30 @@ function onlySpaces(str) {
 
 function sendTextMessage() {
     if (!onlySpaces(text.value)) {
-        ws.send(JSON.stringify({
-            "event": EVENT_TEXT,
-            "user_id": USER_ID,
-            "payload": text.value,
-        }))
+        let correlationID = nextCorrelationID()
+        pendingTexts[correlationID] = text.value
+        sendPendingText(correlationID)
         text.value = ""
     }
 }
 
+function sendPendingText(correlationID) {
+    ws.send(JSON.stringify({
+        "event": EVENT_TEXT,
+        "user_id": USER_ID,
+        "payload": pendingTexts[correlationID],
+        "correlation_id": correlationID,
+        "idempotency_key": correlationID,
+    }))
+}
+
+// resendPendingTexts resends the texts that were not acked before the connection dropped
+function resendPendingTexts() {
+    for (const correlationID in pendingTexts) {
+        sendPendingText(correlationID)
+    }
+}
+
 function sendActionMessage(action) {
     ws.send(JSON.stringify({
         "event": EVENT_ACTION,